@@ -0,0 +1,315 @@
+package main
+
+/*
+	Handles project files (coiler.toml), which let a project keep its build settings in version control.
+	Every path in a project file is relative to the directory containing it.
+*/
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	DEFAULT_PROJECT_FILE = "coiler.toml"
+)
+
+/*
+	Reads the project file at the given [path] into the given [settings].
+*/
+func LoadProjectFile(path string, settings *RunSettings) error {
+
+	var document, binary map[string]interface{}
+	var contents []byte
+	var directory string
+	var ok bool
+	var err error
+
+	contents, err = ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	document, err = ParseToml(string(contents))
+	if err != nil {
+		return err
+	}
+
+	directory = filepath.Dir(path)
+	project := projectTable{values: document, directory: directory}
+
+	project.path("entry", &settings.EntryPointPath)
+	project.path("output", &settings.OutputPath)
+	project.str("mode", &settings.CombineMode)
+	project.str("interpreter", &settings.Interpreter)
+	project.path("venv", &settings.VirtualEnvPath)
+	project.path("wheelhouse", &settings.Wheelhouse)
+	project.path("requirements", &settings.RequirementsPath)
+	project.strings("include", &settings.Include)
+	project.strings("exclude", &settings.Exclude)
+	project.paths("search_paths", &settings.SearchPaths)
+	project.dataFiles("data_files", &settings.DataFiles)
+	project.path("cache_dir", &settings.CacheDirectory)
+	project.str("mangle", &settings.Mangling)
+	project.boolean("preserve_names", &settings.PreserveNames)
+
+	if _, exists := document["binary"]; exists {
+
+		binary, ok = document["binary"].(map[string]interface{})
+		if !ok {
+			return errors.New("'binary' must be a table")
+		}
+
+		binaryTable := projectTable{values: binary, directory: directory, prefix: "binary."}
+		binaryTable.boolean("embed", &settings.ShouldCreateEmbedded)
+		binaryTable.str("codec", &settings.PayloadCodec)
+		binaryTable.path("sign_key", &settings.SigningKeyPath)
+		binaryTable.boolean("require_signature", &settings.RequireSignature)
+
+		err = binaryTable.finish()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = loadProjectTargets(document, directory, settings)
+	if err != nil {
+		return err
+	}
+
+	return project.finish("binary", "target")
+}
+
+/*
+	Reads each [[target]] table of the given project [document], which allows a project to build several entry points.
+	A target without an output is built into the project directory, named after its entry point.
+*/
+func loadProjectTargets(document map[string]interface{}, directory string, settings *RunSettings) error {
+
+	var tables []map[string]interface{}
+	var target BuildTarget
+	var ok bool
+	var err error
+
+	if _, exists := document["target"]; !exists {
+		return nil
+	}
+
+	tables, ok = document["target"].([]map[string]interface{})
+	if !ok {
+		return errors.New("'target' must be an array of tables ([[target]])")
+	}
+
+	for _, table := range tables {
+
+		target = BuildTarget{}
+
+		targetTable := projectTable{values: table, directory: directory, prefix: "target."}
+		targetTable.path("entry", &target.EntryPointPath)
+		targetTable.path("output", &target.OutputPath)
+
+		err = targetTable.finish()
+		if err != nil {
+			return err
+		}
+
+		if target.EntryPointPath == "" {
+			return errors.New("Every [[target]] needs an 'entry'")
+		}
+
+		if target.OutputPath == "" {
+			target.OutputPath = filepath.Join(directory, defaultOutputName(target.EntryPointPath))
+		}
+		settings.Targets = append(settings.Targets, target)
+	}
+	return nil
+}
+
+/*
+	Reads typed values out of one table of a project file, remembering the first problem it encounters.
+*/
+type projectTable struct {
+	values    map[string]interface{}
+	directory string
+	prefix    string
+	used      []string
+	err       error
+}
+
+func (this *projectTable) lookup(key string) (interface{}, bool) {
+
+	var value interface{}
+	var exists bool
+
+	value, exists = this.values[key]
+	if exists {
+		this.used = append(this.used, key)
+	}
+	return value, exists
+}
+
+func (this *projectTable) fail(key string, expected string) {
+
+	if this.err == nil {
+		this.err = errors.New(fmt.Sprintf("'%s%s' must be %s", this.prefix, key, expected))
+	}
+}
+
+func (this *projectTable) str(key string, target *string) {
+
+	value, exists := this.lookup(key)
+	if !exists {
+		return
+	}
+
+	converted, ok := value.(string)
+	if !ok {
+		this.fail(key, "a string")
+		return
+	}
+	*target = converted
+}
+
+func (this *projectTable) path(key string, target *string) {
+
+	var value string
+
+	this.str(key, &value)
+	if value != "" {
+		*target = this.resolve(value)
+	}
+}
+
+func (this *projectTable) boolean(key string, target *bool) {
+
+	value, exists := this.lookup(key)
+	if !exists {
+		return
+	}
+
+	converted, ok := value.(bool)
+	if !ok {
+		this.fail(key, "true or false")
+		return
+	}
+	*target = converted
+}
+
+func (this *projectTable) strings(key string, target *[]string) {
+
+	value, exists := this.lookup(key)
+	if !exists {
+		return
+	}
+
+	values, ok := value.([]interface{})
+	if !ok {
+		this.fail(key, "an array of strings")
+		return
+	}
+
+	*target = nil
+	for _, value := range values {
+
+		converted, ok := value.(string)
+		if !ok {
+			this.fail(key, "an array of strings")
+			return
+		}
+		*target = append(*target, converted)
+	}
+}
+
+func (this *projectTable) paths(key string, target *[]string) {
+
+	this.strings(key, target)
+	for i, path := range *target {
+		(*target)[i] = this.resolve(path)
+	}
+}
+
+/*
+	Expands each glob pattern of the given [key] into a map of embedded names to paths.
+	Each file is embedded under its path relative to the project directory.
+*/
+func (this *projectTable) dataFiles(key string, target *map[string]string) {
+
+	var patterns, matches []string
+	var name string
+	var err error
+
+	this.strings(key, &patterns)
+	if len(patterns) == 0 {
+		return
+	}
+
+	*target = make(map[string]string)
+
+	for _, pattern := range patterns {
+
+		matches, err = filepath.Glob(this.resolve(pattern))
+		if err != nil || len(matches) == 0 {
+			this.fail(key, fmt.Sprintf("a list of patterns which match files ('%s' matched nothing)", pattern))
+			return
+		}
+
+		sort.Strings(matches)
+		for _, match := range matches {
+
+			name, err = filepath.Rel(this.directory, match)
+			if err != nil {
+				name = match
+			}
+			(*target)[filepath.ToSlash(name)] = match
+		}
+	}
+}
+
+func (this *projectTable) resolve(path string) string {
+
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(this.directory, path)
+}
+
+/*
+	Returns the first problem encountered while reading this table, or an error naming any keys which weren't understood.
+	Keys given as [ignored] are expected to be handled elsewhere.
+*/
+func (this *projectTable) finish(ignored ...string) error {
+
+	var unknown []string
+
+	if this.err != nil {
+		return this.err
+	}
+
+	this.used = append(this.used, ignored...)
+
+	for key, _ := range this.values {
+
+		if !containsString(this.used, key) {
+			unknown = append(unknown, this.prefix+key)
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return errors.New(fmt.Sprintf("Unknown project settings: %s", strings.Join(unknown, ", ")))
+	}
+	return nil
+}
+
+func containsString(haystack []string, needle string) bool {
+
+	for _, value := range haystack {
+		if value == needle {
+			return true
+		}
+	}
+	return false
+}
@@ -1,25 +1,528 @@
 package main
 
 import (
+	"coiler"
 	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
 type RunSettings struct {
+
+	// the name of the subcommand being run
+	Command string
+
+	// every entry point to build. EntryPointPath and OutputPath describe the first.
+	Targets []BuildTarget
+
 	CombineMode          string
 	EntryPointPath       string
 	OutputPath           string
 	ShouldCreateEmbedded bool
+	PayloadCodec         string
+	SigningKeyPath       string
+	RequireSignature     bool
+
+	// the artifact given to 'inspect' or 'verify'
+	TargetPath string
+
+	// the public key given to 'verify'
+	VerificationKeyPath string
+
+	// the output format of 'graph'
+	GraphFormat string
+
+	// arguments passed through to the application by 'run'
+	ProgramArguments []string
+
+	// the project file which provided settings, if any
+	ProjectPath string
+
+	Interpreter string
+	Include     []string
+	Exclude     []string
+	SearchPaths []string
+
+	// the virtualenv given by '-venv', whose base interpreter replaces Interpreter once it's been read
+	VirtualEnvPath string
+	VirtualEnv     *coiler.VirtualEnv
+
+	// a directory of wheels, and the requirements (or lock) file which picks from them. The wheels picked are unpacked by the session
+	Wheelhouse       string
+	RequirementsPath string
+
+	// files to embed in the output, keyed by the name they are embedded under
+	DataFiles map[string]string
+
+	// if true, 'build' keeps running and rebuilds whenever sources change
+	Watch bool
+
+	// where parsed files are cached between runs, empty to disable caching
+	CacheDirectory string
+	DisableCache   bool
+
+	// how combined symbols are renamed. One of 'separator', 'hash', or 'index'
+	Mangling string
+
+	// if true, combined functions and classes keep their original runtime names
+	PreserveNames bool
+
+	// how warnings and errors found in source files are printed. One of 'text' or 'json'
+	DiagnosticFormat string
+}
+
+/*
+	Describes a single subcommand.
+*/
+type Command struct {
+	Name        string
+	Usage       string
+	Description string
+
+	// registers the flags this command accepts
+	register func(flags *flag.FlagSet, settings *RunSettings)
+
+	// if true, the first positional argument is the entry point (and may be given instead of -i)
+	takesEntryPoint bool
+
+	// if true, every positional argument is an entry point, each of which is built separately.
+	takesManyEntryPoints bool
 }
 
-func ParseRunSettings() RunSettings {
+/*
+	A single entry point, and the path its combined output is written to.
+*/
+type BuildTarget struct {
+	EntryPointPath string
+	OutputPath     string
+}
+
+var commands = []Command{
+	{
+		Name:                 "build",
+		Usage:                "coiler build [options] <entry point>...",
+		Description:          "Parses the entry point and its imports, and compiles them into a single *.pyc (and optionally a native executable).",
+		register:             registerBuildFlags,
+		takesEntryPoint:      true,
+		takesManyEntryPoints: true,
+	},
+	{
+		Name:                 "check",
+		Usage:                "coiler check [options] <entry point>...",
+		Description:          "Parses the entry point and its imports, and reports what would be combined, without compiling anything.",
+		register:             registerParseFlags,
+		takesEntryPoint:      true,
+		takesManyEntryPoints: true,
+	},
+	{
+		Name:                 "graph",
+		Usage:                "coiler graph [options] <entry point>...",
+		Description:          "Parses the entry point and its imports, and prints the dependency graph of combined modules.",
+		register:             registerGraphFlags,
+		takesEntryPoint:      true,
+		takesManyEntryPoints: true,
+	},
+	{
+		Name:            "run",
+		Usage:           "coiler run [options] <entry point> [--] [application arguments]",
+		Description:     "Builds the entry point to a temporary location and executes it, passing along any remaining arguments.",
+		register:        registerRunFlags,
+		takesEntryPoint: true,
+	},
+	{
+		Name:        "inspect",
+		Usage:       "coiler inspect <pyc or binary>",
+		Description: "Describes an existing *.pyc or native executable made by coiler.",
+		register:    func(flags *flag.FlagSet, settings *RunSettings) {},
+	},
+	{
+		Name:        "verify",
+		Usage:       "coiler verify -k <public key> <binary>",
+		Description: "Checks the signature of a native executable, exiting non-zero if it is missing or invalid.",
+		register:    registerVerifyFlags,
+	},
+}
+
+/*
+	Parses the given command-line [arguments] (not including the program name).
+	If no subcommand is given, the arguments are treated as flags to 'build', for compatibility with older invocations.
+*/
+func ParseRunSettings(arguments []string) RunSettings {
 
 	var ret RunSettings
+	var command Command
+	var flags *flag.FlagSet
+	var found bool
+	var err error
+
+	if len(arguments) == 0 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	switch arguments[0] {
+	case "help", "-h", "-help", "--help":
+
+		// 'help <command>' is the same as '<command> -h', so that defaults (and any project file) are shown the same way by both.
+		if len(arguments) > 1 {
+			if _, found = findCommand(arguments[1]); found {
+				arguments = []string{arguments[1], "-h"}
+				break
+			}
+		}
+
+		printUsage()
+		os.Exit(0)
+	}
+
+	command, found = findCommand(arguments[0])
+	if found {
+		arguments = arguments[1:]
+	} else {
 
-	flag.StringVar(&ret.CombineMode, "m", "user", "Mode for parsing. 'user' will combine only user and third-party modules together, 'all' will also include system libraries")
-	flag.StringVar(&ret.OutputPath, "o", "./a.pyc", "Path to output a final '*.pyc' file")
-	flag.StringVar(&ret.EntryPointPath, "i", "", "Path to the input entry point")
-	flag.BoolVar(&ret.ShouldCreateEmbedded, "e", false, "Whether or not to create a native executable that runs the combined python application")
-	flag.Parse()
+		if !strings.HasPrefix(arguments[0], "-") {
+			fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n", arguments[0])
+			printUsage()
+			os.Exit(2)
+		}
 
+		// older invocations used flags without a command, those always meant 'build'.
+		command, _ = findCommand("build")
+	}
+
+	ret.Command = command.Name
+	ret.CombineMode = "user"
+	ret.OutputPath = "./a.pyc"
+	ret.PayloadCodec = "zlib"
+	ret.GraphFormat = "text"
+	ret.Interpreter = "python"
+	ret.CacheDirectory = coiler.DefaultCacheDirectory()
+	ret.Mangling = coiler.MANGLE_SEPARATOR
+	ret.DiagnosticFormat = "text"
+
+	// project file settings are loaded first, so that they become the defaults which flags override.
+	if command.takesEntryPoint {
+
+		ret.ProjectPath = findProjectPath(arguments)
+		if ret.ProjectPath != "" {
+
+			err = LoadProjectFile(ret.ProjectPath, &ret)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to load project file '%s': \n%v\n", ret.ProjectPath, err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	flags = newCommandFlags(command, &ret)
+	flags.Parse(arguments)
+	arguments = flags.Args()
+
+	// commands which take many entry points allow flags to be given between (or after) them.
+	if command.takesManyEntryPoints {
+		arguments = parseInterspersed(flags, arguments)
+	}
+
+	if ret.VirtualEnvPath != "" {
+
+		ret.VirtualEnv, err = coiler.OpenVirtualEnv(ret.VirtualEnvPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to use virtualenv: \n%v\n", err)
+			os.Exit(1)
+		}
+		ret.Interpreter = ret.VirtualEnv.BaseInterpreter
+	}
+
+	if (ret.Wheelhouse == "") != (ret.RequirementsPath == "") {
+		fmt.Fprintf(os.Stderr, "A wheelhouse and a requirements file must be given together\n")
+		os.Exit(2)
+	}
+
+	if ret.DiagnosticFormat != "text" && ret.DiagnosticFormat != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown diagnostics format '%s'\n", ret.DiagnosticFormat)
+		os.Exit(2)
+	}
+
+	if command.takesEntryPoint {
+
+		arguments = ret.determineTargets(command, flags, arguments)
+
+		if len(ret.Targets) == 0 {
+			fmt.Fprintf(os.Stderr, "No entry point given\n\n")
+			flags.Usage()
+			os.Exit(2)
+		}
+
+		if len(ret.Targets) > 1 && !command.takesManyEntryPoints {
+			fmt.Fprintf(os.Stderr, "'%s' only accepts a single entry point\n", command.Name)
+			os.Exit(2)
+		}
+
+		ret.EntryPointPath = ret.Targets[0].EntryPointPath
+		ret.OutputPath = ret.Targets[0].OutputPath
+	} else {
+
+		if len(arguments) == 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+
+		ret.TargetPath = arguments[0]
+		arguments = arguments[1:]
+	}
+
+	if len(arguments) > 0 && arguments[0] == "--" {
+		arguments = arguments[1:]
+	}
+	ret.ProgramArguments = arguments
 	return ret
 }
+
+/*
+	Determines the entry points (and the output for each) from the given positional [arguments], flags, and project file.
+	Positional entry points override those of a project file, as does an entry point given by flag.
+	When several entry points are given on the command line, the output flag names a directory.
+	Returns whichever arguments weren't used.
+*/
+func (this *RunSettings) determineTargets(command Command, flags *flag.FlagSet, arguments []string) []string {
+
+	var entryPoints []string
+	var outputDirectory string
+	var count int
+
+	if wasFlagSet(flags, "input", "i") {
+		entryPoints = append(entryPoints, this.EntryPointPath)
+	}
+
+	if command.takesManyEntryPoints {
+		count = len(arguments)
+	} else if len(entryPoints) == 0 {
+		count = 1
+	}
+
+	for len(arguments) > 0 && arguments[0] != "--" && count > 0 {
+		entryPoints = append(entryPoints, arguments[0])
+		arguments = arguments[1:]
+		count--
+	}
+
+	if len(entryPoints) == 0 {
+
+		// nothing given on the command line; use the targets of the project file, or its single entry point.
+		if len(this.Targets) == 0 && this.EntryPointPath != "" {
+			this.Targets = []BuildTarget{{EntryPointPath: this.EntryPointPath, OutputPath: this.OutputPath}}
+		}
+		return arguments
+	}
+
+	if len(entryPoints) == 1 {
+		this.Targets = []BuildTarget{{EntryPointPath: entryPoints[0], OutputPath: this.OutputPath}}
+		return arguments
+	}
+
+	outputDirectory = "."
+	if wasFlagSet(flags, "output", "o") {
+		outputDirectory = this.OutputPath
+	}
+
+	this.Targets = nil
+	for _, entryPoint := range entryPoints {
+		this.Targets = append(this.Targets, BuildTarget{
+			EntryPointPath: entryPoint,
+			OutputPath:     filepath.Join(outputDirectory, defaultOutputName(entryPoint)),
+		})
+	}
+	return arguments
+}
+
+/*
+	Returns the name of the *.pyc built from the given [entryPoint] when no output is named explicitly.
+*/
+func defaultOutputName(entryPoint string) string {
+
+	var baseName string
+
+	baseName = filepath.Base(entryPoint)
+	return strings.TrimSuffix(baseName, filepath.Ext(baseName)) + ".pyc"
+}
+
+/*
+	Continues parsing flags from the given [arguments] (which start with a positional argument) until they're exhausted or "--" is found.
+	Returns the positional arguments, followed by "--" and everything after it, if it was given.
+*/
+func parseInterspersed(flags *flag.FlagSet, arguments []string) []string {
+
+	var positional []string
+
+	for len(arguments) > 0 && arguments[0] != "--" {
+
+		positional = append(positional, arguments[0])
+		flags.Parse(arguments[1:])
+		arguments = flags.Args()
+	}
+	return append(positional, arguments...)
+}
+
+/*
+	Returns the project file named by a '-project' flag in the given [arguments],
+	or DEFAULT_PROJECT_FILE if none is given and it exists in the working directory.
+*/
+func findProjectPath(arguments []string) string {
+
+	var name string
+
+	for i, argument := range arguments {
+
+		if argument == "--" {
+			break
+		}
+
+		name = strings.TrimLeft(argument, "-")
+		if name == argument {
+			continue
+		}
+
+		if strings.HasPrefix(name, "project=") {
+			return strings.TrimPrefix(name, "project=")
+		}
+
+		if name == "project" && i+1 < len(arguments) {
+			return arguments[i+1]
+		}
+	}
+
+	if _, err := os.Stat(DEFAULT_PROJECT_FILE); err == nil {
+		return DEFAULT_PROJECT_FILE
+	}
+	return ""
+}
+
+/*
+	Returns true if any of the given flag [names] were given on the command line.
+*/
+func wasFlagSet(flags *flag.FlagSet, names ...string) bool {
+
+	var found bool
+
+	flags.Visit(func(set *flag.Flag) {
+		for _, name := range names {
+			if set.Name == name {
+				found = true
+			}
+		}
+	})
+	return found
+}
+
+func findCommand(name string) (Command, bool) {
+
+	for _, command := range commands {
+		if command.Name == name {
+			return command, true
+		}
+	}
+	return Command{}, false
+}
+
+func newCommandFlags(command Command, settings *RunSettings) *flag.FlagSet {
+
+	var flags *flag.FlagSet
+
+	flags = flag.NewFlagSet(command.Name, flag.ExitOnError)
+	flags.Usage = func() {
+
+		fmt.Fprintf(os.Stderr, "Usage: %s\n\n%s\n\n", command.Usage, command.Description)
+		flags.PrintDefaults()
+	}
+
+	command.register(flags, settings)
+	return flags
+}
+
+func printUsage() {
+
+	fmt.Fprintf(os.Stderr, "Usage: coiler <command> [options]\n\nCommands:\n")
+
+	for _, command := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s%s\n", command.Name, command.Description)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nUse 'coiler help <command>' for the options of a command.\n")
+}
+
+func registerParseFlags(flags *flag.FlagSet, settings *RunSettings) {
+
+	stringFlag(flags, &settings.CombineMode, "mode", "m", "Mode for parsing. 'user' will combine only user and third-party modules together, 'all' will also include system libraries")
+	stringFlag(flags, &settings.EntryPointPath, "input", "i", "Path to the input entry point")
+	flags.StringVar(&settings.Interpreter, "interpreter", settings.Interpreter, "The python interpreter used to find modules and compile output")
+	flags.StringVar(&settings.Wheelhouse, "wheelhouse", settings.Wheelhouse, "Directory of '.whl' files from which the packages named by -requirements are combined, without a network")
+	flags.StringVar(&settings.RequirementsPath, "requirements", settings.RequirementsPath, "Requirements (or lock) file naming the packages to take from -wheelhouse")
+	flags.StringVar(&settings.VirtualEnvPath, "venv", settings.VirtualEnvPath, "Path to a virtualenv whose site-packages provide third-party modules. Its base interpreter is used instead of -interpreter")
+	flags.StringVar(&settings.ProjectPath, "project", settings.ProjectPath, "Path to a project file. Defaults to '"+DEFAULT_PROJECT_FILE+"', if it exists")
+	flags.StringVar(&settings.CacheDirectory, "cache-dir", settings.CacheDirectory, "Directory in which parsed files are cached between runs")
+	flags.BoolVar(&settings.DisableCache, "no-cache", settings.DisableCache, "Re-parse every file, without reading or writing the cache")
+	flags.StringVar(&settings.DiagnosticFormat, "diagnostics", settings.DiagnosticFormat, "How warnings and errors in source files are printed. One of 'text' or 'json' (one object per line)")
+	flags.StringVar(&settings.Mangling, "mangle", settings.Mangling, "How combined symbols are renamed. One of 'separator', 'hash' (collision-proof), or 'index' (collision-proof)")
+}
+
+func registerBuildFlags(flags *flag.FlagSet, settings *RunSettings) {
+
+	registerParseFlags(flags, settings)
+	stringFlag(flags, &settings.OutputPath, "output", "o", "Path to output a final '*.pyc' file. When building several entry points, the directory to output each into")
+	flags.BoolVar(&settings.Watch, "watch", settings.Watch, "Keep running, and rebuild whenever a source file or lookup directory changes")
+	registerOutputFlags(flags, settings)
+	registerBinaryFlags(flags, settings)
+}
+
+func registerRunFlags(flags *flag.FlagSet, settings *RunSettings) {
+
+	registerParseFlags(flags, settings)
+	registerOutputFlags(flags, settings)
+	registerBinaryFlags(flags, settings)
+}
+
+func registerOutputFlags(flags *flag.FlagSet, settings *RunSettings) {
+
+	flags.BoolVar(&settings.PreserveNames, "preserve-names", settings.PreserveNames, "Whether or not combined functions and classes keep their original __name__, __qualname__ and __module__ (for pickle, logging and reprs)")
+}
+
+func registerBinaryFlags(flags *flag.FlagSet, settings *RunSettings) {
+
+	boolFlag(flags, &settings.ShouldCreateEmbedded, "embed", "e", "Whether or not to create a native executable that runs the combined python application")
+	stringFlag(flags, &settings.PayloadCodec, "codec", "z", "Compression to use for the payload of a native executable. One of 'none', 'zlib', or 'zstd'")
+	stringFlag(flags, &settings.SigningKeyPath, "sign-key", "k", "Path to a PEM-encoded Ed25519 private key used to sign the payload of a native executable")
+	boolFlag(flags, &settings.RequireSignature, "require-signature", "r", "Whether or not a native executable should refuse to run if its payload signature is invalid (requires -k)")
+}
+
+func registerGraphFlags(flags *flag.FlagSet, settings *RunSettings) {
+
+	registerParseFlags(flags, settings)
+	flags.StringVar(&settings.GraphFormat, "format", settings.GraphFormat, "Output format of the graph. One of 'text' or 'dot'")
+}
+
+func registerVerifyFlags(flags *flag.FlagSet, settings *RunSettings) {
+
+	stringFlag(flags, &settings.VerificationKeyPath, "key", "k", "Path to the PEM-encoded Ed25519 public key which the binary should be signed with")
+}
+
+/*
+	Registers a string flag under both a long [name] and a short [alias].
+	The current value of [target] is used as the default.
+*/
+func stringFlag(flags *flag.FlagSet, target *string, name string, alias string, usage string) {
+
+	flags.StringVar(target, name, *target, usage)
+	flags.StringVar(target, alias, *target, "Alias for -"+name)
+}
+
+/*
+	Registers a boolean flag under both a long [name] and a short [alias].
+	The current value of [target] is used as the default.
+*/
+func boolFlag(flags *flag.FlagSet, target *bool, name string, alias string, usage string) {
+
+	flags.BoolVar(target, name, *target, usage)
+	flags.BoolVar(target, alias, *target, "Alias for -"+name)
+}
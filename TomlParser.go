@@ -0,0 +1,315 @@
+package main
+
+/*
+	A parser for the subset of TOML used by project files:
+	tables, arrays of tables, strings, booleans, integers, and (possibly multi-line) arrays of those.
+*/
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+	Parses the given TOML [source]. Tables are returned as nested maps, arrays of tables as slices of maps.
+*/
+func ParseToml(source string) (map[string]interface{}, error) {
+
+	var ret, table map[string]interface{}
+	var lines []string
+	var line, key, header string
+	var value interface{}
+	var lineNumber int
+	var err error
+
+	ret = make(map[string]interface{})
+	table = ret
+	lines = strings.Split(source, "\n")
+
+	for lineNumber = 0; lineNumber < len(lines); lineNumber++ {
+
+		line = strings.TrimSpace(stripTomlComment(lines[lineNumber]))
+		if line == "" {
+			continue
+		}
+
+		// array of tables
+		if strings.HasPrefix(line, "[[") {
+
+			if !strings.HasSuffix(line, "]]") {
+				return nil, tomlError(lineNumber, "unterminated table header")
+			}
+
+			header = strings.TrimSpace(line[2 : len(line)-2])
+			tables, _ := ret[header].([]map[string]interface{})
+			if _, exists := ret[header]; exists && tables == nil {
+				return nil, tomlError(lineNumber, fmt.Sprintf("'%s' is already defined as a value", header))
+			}
+
+			table = make(map[string]interface{})
+			ret[header] = append(tables, table)
+			continue
+		}
+
+		// table
+		if strings.HasPrefix(line, "[") {
+
+			if !strings.HasSuffix(line, "]") {
+				return nil, tomlError(lineNumber, "unterminated table header")
+			}
+
+			header = strings.TrimSpace(line[1 : len(line)-1])
+			if _, exists := ret[header]; exists {
+				return nil, tomlError(lineNumber, fmt.Sprintf("table '%s' is defined more than once", header))
+			}
+
+			table = make(map[string]interface{})
+			ret[header] = table
+			continue
+		}
+
+		// key/value pair. Arrays may continue on following lines until their brackets balance.
+		for !tomlBracketsBalanced(line) && lineNumber+1 < len(lines) {
+			lineNumber++
+			line += " " + strings.TrimSpace(stripTomlComment(lines[lineNumber]))
+		}
+
+		key, value, err = parseTomlPair(line)
+		if err != nil {
+			return nil, tomlError(lineNumber, err.Error())
+		}
+
+		if _, exists := table[key]; exists {
+			return nil, tomlError(lineNumber, fmt.Sprintf("key '%s' is defined more than once", key))
+		}
+		table[key] = value
+	}
+
+	return ret, nil
+}
+
+func parseTomlPair(line string) (string, interface{}, error) {
+
+	var key string
+	var value interface{}
+	var remainder string
+	var index int
+	var err error
+
+	line = strings.TrimSpace(line)
+
+	// a quoted key may contain '=' itself, so it's read like a string value.
+	if strings.HasPrefix(line, "\"") || strings.HasPrefix(line, "'") {
+
+		key, remainder, err = parseTomlString(line)
+		if err != nil {
+			return "", nil, errors.New("invalid quoted key")
+		}
+
+		remainder = strings.TrimSpace(remainder)
+		if !strings.HasPrefix(remainder, "=") {
+			return "", nil, errors.New("expected 'key = value'")
+		}
+		remainder = remainder[1:]
+	} else {
+
+		index = strings.Index(line, "=")
+		if index < 0 {
+			return "", nil, errors.New("expected 'key = value'")
+		}
+
+		key = strings.TrimSpace(line[:index])
+		remainder = line[index+1:]
+	}
+
+	if key == "" {
+		return "", nil, errors.New("missing key")
+	}
+
+	value, remainder, err = parseTomlValue(strings.TrimSpace(remainder))
+	if err != nil {
+		return "", nil, err
+	}
+
+	if strings.TrimSpace(remainder) != "" {
+		return "", nil, errors.New(fmt.Sprintf("unexpected '%s' after value", strings.TrimSpace(remainder)))
+	}
+	return key, value, nil
+}
+
+/*
+	Parses a single value from the start of [source], returning the value and whatever follows it.
+*/
+func parseTomlValue(source string) (interface{}, string, error) {
+
+	var values []interface{}
+	var value interface{}
+	var end int
+	var err error
+
+	if source == "" {
+		return nil, "", errors.New("missing value")
+	}
+
+	switch {
+	case source[0] == '"' || source[0] == '\'':
+		return parseTomlString(source)
+
+	case strings.HasPrefix(source, "true"):
+		return true, source[4:], nil
+
+	case strings.HasPrefix(source, "false"):
+		return false, source[5:], nil
+
+	case source[0] == '[':
+
+		source = strings.TrimSpace(source[1:])
+		values = make([]interface{}, 0)
+
+		for !strings.HasPrefix(source, "]") {
+
+			value, source, err = parseTomlValue(source)
+			if err != nil {
+				return nil, "", err
+			}
+			values = append(values, value)
+
+			source = strings.TrimSpace(source)
+			if strings.HasPrefix(source, ",") {
+				source = strings.TrimSpace(source[1:])
+				continue
+			}
+
+			if !strings.HasPrefix(source, "]") {
+				return nil, "", errors.New("expected ',' or ']' in array")
+			}
+		}
+		return values, source[1:], nil
+	}
+
+	end = strings.IndexAny(source, " \t,]")
+	if end < 0 {
+		end = len(source)
+	}
+
+	value, err = strconv.ParseInt(strings.Replace(source[:end], "_", "", -1), 0, 64)
+	if err != nil {
+		return nil, "", errors.New(fmt.Sprintf("unsupported value '%s'", source[:end]))
+	}
+	return value, source[end:], nil
+}
+
+/*
+	Parses a basic ("...") or literal ('...') string from the start of [source].
+*/
+func parseTomlString(source string) (string, string, error) {
+
+	var builder strings.Builder
+	var quote byte
+	var code uint64
+	var err error
+
+	quote = source[0]
+
+	for i := 1; i < len(source); i++ {
+
+		if source[i] == quote {
+			return builder.String(), source[i+1:], nil
+		}
+
+		if source[i] != '\\' || quote == '\'' {
+			builder.WriteByte(source[i])
+			continue
+		}
+
+		i++
+		if i >= len(source) {
+			break
+		}
+
+		switch source[i] {
+		case 'n':
+			builder.WriteByte('\n')
+		case 't':
+			builder.WriteByte('\t')
+		case 'r':
+			builder.WriteByte('\r')
+		case '"', '\\':
+			builder.WriteByte(source[i])
+		case 'u':
+
+			if i+4 >= len(source) {
+				return "", "", errors.New("invalid unicode escape")
+			}
+
+			code, err = strconv.ParseUint(source[i+1:i+5], 16, 32)
+			if err != nil {
+				return "", "", errors.New("invalid unicode escape")
+			}
+
+			builder.WriteRune(rune(code))
+			i += 4
+		default:
+			return "", "", errors.New(fmt.Sprintf("unsupported escape '\\%c'", source[i]))
+		}
+	}
+
+	return "", "", errors.New("unterminated string")
+}
+
+/*
+	Removes any comment from the given [line], ignoring '#' characters inside of strings.
+*/
+func stripTomlComment(line string) string {
+
+	var quote byte
+	var escaped bool
+
+	for i := 0; i < len(line); i++ {
+
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && line[i] == '\\':
+			escaped = true
+		case quote != 0 && line[i] == quote:
+			quote = 0
+		case quote == 0 && (line[i] == '"' || line[i] == '\''):
+			quote = line[i]
+		case quote == 0 && line[i] == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func tomlBracketsBalanced(line string) bool {
+
+	var depth int
+	var quote byte
+	var escaped bool
+
+	for i := 0; i < len(line); i++ {
+
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && line[i] == '\\':
+			escaped = true
+		case quote != 0 && line[i] == quote:
+			quote = 0
+		case quote == 0 && (line[i] == '"' || line[i] == '\''):
+			quote = line[i]
+		case quote == 0 && line[i] == '[':
+			depth++
+		case quote == 0 && line[i] == ']':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+func tomlError(lineNumber int, message string) error {
+	return errors.New(fmt.Sprintf("line %d: %s", lineNumber+1, message))
+}
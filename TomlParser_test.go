@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseToml(test *testing.T) {
+
+	var cases = []struct {
+		name     string
+		source   string
+		expected map[string]interface{}
+	}{
+		{
+			name:     "scalars",
+			source:   "entry = \"main.py\"\nembed = true\nwatch = false\ncount = 1_000\n",
+			expected: map[string]interface{}{"entry": "main.py", "embed": true, "watch": false, "count": int64(1000)},
+		},
+		{
+			name:     "comments",
+			source:   "# leading\nentry = \"a#b.py\" # trailing\nname = 'c#d' #",
+			expected: map[string]interface{}{"entry": "a#b.py", "name": "c#d"},
+		},
+		{
+			name:     "escapes",
+			source:   `value = "a\tb\n\"c\"\\d\u00e9"` + "\nliteral = 'C:\\path\\n'",
+			expected: map[string]interface{}{"value": "a\tb\n\"c\"\\dé", "literal": "C:\\path\\n"},
+		},
+		{
+			name:     "quoted key",
+			source:   `"odd key" = 1`,
+			expected: map[string]interface{}{"odd key": int64(1)},
+		},
+		{
+			name:     "quoted keys with equals",
+			source:   "\"a=b\" = 1\n'c = d' = \"e = f\"\n" + `"\"=\"" = true`,
+			expected: map[string]interface{}{"a=b": int64(1), "c = d": "e = f", `"="`: true},
+		},
+		{
+			name:     "arrays",
+			source:   "empty = []\nnested = [[1, 2], [\"a\"]]\ntrailing = [\"x\", \"y\",]",
+			expected: map[string]interface{}{"empty": []interface{}{}, "nested": []interface{}{[]interface{}{int64(1), int64(2)}, []interface{}{"a"}}, "trailing": []interface{}{"x", "y"}},
+		},
+		{
+			name:     "multi-line array",
+			source:   "exclude = [\n\t\"test_*\", # tests\n\t\"[bracket]\",\n]\nafter = true",
+			expected: map[string]interface{}{"exclude": []interface{}{"test_*", "[bracket]"}, "after": true},
+		},
+		{
+			name:   "tables",
+			source: "entry = \"main.py\"\n[binary]\nembed = true\ncodec = \"zstd\"",
+			expected: map[string]interface{}{
+				"entry":  "main.py",
+				"binary": map[string]interface{}{"embed": true, "codec": "zstd"},
+			},
+		},
+		{
+			name:   "arrays of tables",
+			source: "[[target]]\nentry = \"a.py\"\n\n[[target]]\nentry = \"b.py\"\noutput = \"b.pyc\"",
+			expected: map[string]interface{}{
+				"target": []map[string]interface{}{
+					{"entry": "a.py"},
+					{"entry": "b.py", "output": "b.pyc"},
+				},
+			},
+		},
+	}
+
+	for _, testCase := range cases {
+
+		actual, err := ParseToml(testCase.source)
+		if err != nil {
+			test.Errorf("%s: unexpected error: %v", testCase.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(actual, testCase.expected) {
+			test.Errorf("%s: expected %#v, got %#v", testCase.name, testCase.expected, actual)
+		}
+	}
+}
+
+func TestParseTomlErrors(test *testing.T) {
+
+	var cases = []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{"missing value", "entry =", "line 1: missing value"},
+		{"missing equals", "\nentry", "line 2: expected 'key = value'"},
+		{"missing key", "= 1", "line 1: missing key"},
+		{"quoted key without value", "\"a=b\"", "line 1: expected 'key = value'"},
+		{"unterminated quoted key", "\"a=b = 1", "line 1: invalid quoted key"},
+		{"duplicate key", "a = 1\na = 2", "line 2: key 'a' is defined more than once"},
+		{"duplicate table", "[binary]\n[binary]", "line 2: table 'binary' is defined more than once"},
+		{"table redefines value", "target = 1\n[[target]]", "line 2: 'target' is already defined as a value"},
+		{"unterminated header", "[binary", "line 1: unterminated table header"},
+		{"unterminated string", "entry = \"main.py", "line 1: unterminated string"},
+		{"unsupported escape", `entry = "\q"`, "line 1: unsupported escape '\\q'"},
+		{"unsupported value", "when = 1979-05-27", "line 1: unsupported value '1979-05-27'"},
+		{"trailing garbage", "entry = \"a\" \"b\"", "line 1: unexpected '\"b\"' after value"},
+		{"unbalanced array", "items = [1 2]", "line 1: expected ',' or ']' in array"},
+	}
+
+	for _, testCase := range cases {
+
+		_, err := ParseToml(testCase.source)
+		if err == nil {
+			test.Errorf("%s: expected an error", testCase.name)
+			continue
+		}
+
+		if err.Error() != testCase.expected {
+			test.Errorf("%s: expected error '%s', got '%s'", testCase.name, testCase.expected, err.Error())
+		}
+	}
+}
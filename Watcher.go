@@ -0,0 +1,290 @@
+package main
+
+import (
+	"coiler"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	WATCH_INTERVAL = 500 * time.Millisecond
+)
+
+/*
+	Polls a set of files and directories for changes.
+	Directories are considered changed when their own modification time changes (such as when a file is added or removed).
+*/
+type Watcher struct {
+	states map[string]fileState
+}
+
+type fileState struct {
+	modified time.Time
+	size     int64
+	exists   bool
+}
+
+func NewWatcher() *Watcher {
+
+	var ret *Watcher
+
+	ret = new(Watcher)
+	ret.states = make(map[string]fileState)
+	return ret
+}
+
+/*
+	Replaces the set of watched paths with the given [paths], recording their current state.
+	Paths which were already watched keep their previous state, so that changes made during a build are not missed.
+*/
+func (this *Watcher) Watch(paths []string) {
+
+	var states map[string]fileState
+	var state fileState
+	var found bool
+
+	states = make(map[string]fileState)
+
+	for _, path := range paths {
+
+		state, found = this.states[path]
+		if !found {
+			state = readFileState(path)
+		}
+		states[path] = state
+	}
+
+	this.states = states
+}
+
+/*
+	Returns every watched path which has changed since the last poll.
+*/
+func (this *Watcher) Poll() []string {
+
+	var ret []string
+	var current fileState
+
+	for path, previous := range this.states {
+
+		current = readFileState(path)
+		if current != previous {
+
+			this.states[path] = current
+			ret = append(ret, path)
+		}
+	}
+	return ret
+}
+
+func readFileState(path string) fileState {
+
+	var info os.FileInfo
+	var err error
+
+	info, err = os.Stat(path)
+	if err != nil {
+		return fileState{}
+	}
+
+	return fileState{modified: info.ModTime(), size: info.Size(), exists: true}
+}
+
+/*
+	Builds every target in [settings], then rebuilds the targets affected by each change to their sources or lookup directories,
+	until interrupted.
+*/
+func watch(settings RunSettings) {
+
+	var session *coiler.BuildSession
+	var watcher *Watcher
+	var contexts []*coiler.BuildContext
+	var sources [][]string
+	var affected []int
+	var changed []string
+
+	session = newSession(settings)
+	closeOnInterrupt(session)
+	watcher = NewWatcher()
+	contexts = make([]*coiler.BuildContext, len(settings.Targets))
+	sources = make([][]string, len(settings.Targets))
+
+	for i, _ := range settings.Targets {
+		affected = append(affected, i)
+	}
+
+	for {
+
+		rebuildTargets(settings, session, contexts, sources, affected)
+		watcher.Watch(watchedPaths(settings, session, sources))
+
+		for {
+			time.Sleep(WATCH_INTERVAL)
+
+			changed = watcher.Poll()
+			if len(changed) > 0 {
+				break
+			}
+		}
+
+		affected = affectedTargets(settings, session, contexts, sources, changed)
+	}
+}
+
+/*
+	Closes the given [session] and exits once the process is interrupted or terminated, which is the only way watching ends.
+*/
+func closeOnInterrupt(session *coiler.BuildSession) {
+
+	var interrupts chan os.Signal
+
+	interrupts = make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+
+		<-interrupts
+		session.Close()
+
+		// as a shell reports a process ended by an interrupt.
+		os.Exit(130)
+	}()
+}
+
+/*
+	Rebuilds the targets at the given [indices], replacing their entries in [contexts], and prints a status line.
+	The source files of each target are updated in [sources]. A target which fails to parse keeps those of its last build,
+	and gains any the failed parse reached, so that a fix to any of them rebuilds it.
+*/
+func rebuildTargets(settings RunSettings, session *coiler.BuildSession, contexts []*coiler.BuildContext, sources [][]string, indices []int) {
+
+	var targets []BuildTarget
+	var rebuilt []*coiler.BuildContext
+	var buildErrors []error
+	var diagnosticError *coiler.DiagnosticError
+	var names, failures []string
+	var startTime time.Time
+
+	startTime = time.Now()
+
+	for _, index := range indices {
+		targets = append(targets, settings.Targets[index])
+		names = append(names, settings.Targets[index].EntryPointPath)
+	}
+
+	rebuilt, buildErrors = buildTargets(settings, session, targets, false)
+
+	for i, index := range indices {
+
+		contexts[index] = rebuilt[i]
+
+		switch {
+		case rebuilt[i] != nil:
+
+			sources[index] = nil
+			for _, file := range rebuilt[i].GetCombinedFiles() {
+				sources[index] = append(sources[index], file.GetPath())
+			}
+
+		case errors.As(buildErrors[i], &diagnosticError):
+
+			for _, path := range diagnosticError.Paths {
+				if !containsString(sources[index], path) {
+					sources[index] = append(sources[index], path)
+				}
+			}
+		}
+
+		if buildErrors[i] != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", targets[i].EntryPointPath, buildErrors[i]))
+		}
+	}
+
+	if len(failures) > 0 {
+		fmt.Printf("[%s] FAILED %d/%d (%s)\n", startTime.Format("15:04:05"), len(failures), len(targets), strings.Join(names, ", "))
+		fmt.Printf("%s\n", strings.Join(failures, "\n"))
+		return
+	}
+
+	fmt.Printf("[%s] built %d/%d in %dms (%s)\n", startTime.Format("15:04:05"), len(targets), len(settings.Targets), elapsedMilliseconds(startTime), strings.Join(names, ", "))
+}
+
+/*
+	Returns the lookup directories, every source file of each target (see rebuildTargets), every data file,
+	and every entry point (in case it failed to parse).
+*/
+func watchedPaths(settings RunSettings, session *coiler.BuildSession, sources [][]string) []string {
+
+	var ret []string
+
+	ret = append(ret, session.GetLookupPaths()...)
+
+	for _, path := range settings.DataFiles {
+		ret = append(ret, path)
+	}
+
+	for i, target := range settings.Targets {
+
+		ret = append(ret, target.EntryPointPath)
+		ret = append(ret, sources[i]...)
+	}
+	return ret
+}
+
+/*
+	Determines which targets need to be rebuilt because of the given [changed] paths.
+	A change to a lookup directory may change which modules are found at all, so it affects every target.
+	Targets which failed are rebuilt by any change.
+*/
+func affectedTargets(settings RunSettings, session *coiler.BuildSession, contexts []*coiler.BuildContext, sources [][]string, changed []string) []int {
+
+	var ret []int
+	var everything bool
+
+	for _, path := range changed {
+
+		if containsString(session.GetLookupPaths(), path) || containsString(mapValues(settings.DataFiles), path) {
+			everything = true
+		}
+	}
+
+	if everything {
+
+		session.RefreshLookupFiles()
+		for i, _ := range settings.Targets {
+			ret = append(ret, i)
+		}
+		return ret
+	}
+
+	for i, target := range settings.Targets {
+
+		if contexts[i] == nil || containsString(changed, target.EntryPointPath) {
+			ret = append(ret, i)
+			continue
+		}
+
+		for _, path := range sources[i] {
+			if containsString(changed, path) {
+				ret = append(ret, i)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+func mapValues(source map[string]string) []string {
+
+	var ret []string
+
+	for _, value := range source {
+		ret = append(ret, value)
+	}
+	return ret
+}
@@ -2,58 +2,486 @@ package main
 
 import (
 	"coiler"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
 func main() {
 
 	var settings RunSettings
+
+	settings = ParseRunSettings(os.Args[1:])
+
+	switch settings.Command {
+	case "build":
+		build(settings)
+	case "check":
+		check(settings)
+	case "graph":
+		graph(settings)
+	case "run":
+		run(settings)
+	case "inspect":
+		inspect(settings)
+	case "verify":
+		verify(settings)
+	}
+}
+
+/*
+	Creates a session which shares module lookups and parsed files between every target in the given [settings].
+*/
+func newSession(settings RunSettings) *coiler.BuildSession {
+
+	var session *coiler.BuildSession
+	var options coiler.BuildOptions
+	var err error
+
+	if settings.DisableCache {
+		settings.CacheDirectory = ""
+	}
+
+	options = coiler.BuildOptions{
+		UseSystemPaths:   settings.CombineMode == "all",
+		Interpreter:      settings.Interpreter,
+		SearchPaths:      settings.SearchPaths,
+		Wheelhouse:       settings.Wheelhouse,
+		RequirementsPath: settings.RequirementsPath,
+		VirtualEnv:       settings.VirtualEnv,
+		Include:          settings.Include,
+		Exclude:          settings.Exclude,
+		DataFiles:        settings.DataFiles,
+		CacheDirectory:   settings.CacheDirectory,
+		Mangling:         settings.Mangling,
+		PreserveNames:    settings.PreserveNames,
+	}
+
+	session, err = coiler.NewBuildSession(options)
+	if err != nil {
+		printError(1, "%v\n", err)
+	}
+	return session
+}
+
+/*
+	Parses the entry point of the given [target], exiting if it can't be parsed.
+*/
+func parse(settings RunSettings, session *coiler.BuildSession, target BuildTarget) *coiler.BuildContext {
+
 	var context *coiler.BuildContext
-	var startTime, currentTime time.Time
-	var elapsed int64
+	var err error
+
+	context, err = parseTarget(settings, session, target, newLogger(""))
+	if err != nil {
+		session.Close()
+		printError(1, "Unable to parse source files: \n%v\n", err)
+		return nil
+	}
+	return context
+}
+
+/*
+	Parses the entry point of the given [target], printing any diagnostics found along the way.
+*/
+func parseTarget(settings RunSettings, session *coiler.BuildSession, target BuildTarget, log logger) (*coiler.BuildContext, error) {
+
+	var context *coiler.BuildContext
+	var diagnosticError *coiler.DiagnosticError
+	var startTime time.Time
 	var err error
 
 	startTime = time.Now()
-	settings = ParseRunSettings()
 
-	context, err = coiler.Parse(settings.EntryPointPath, settings.CombineMode == "all")
+	context, err = session.Parse(target.EntryPointPath)
 	if err != nil {
-		printError(1, "Unable to parse source files: \n%v\n", err)
+
+		if errors.As(err, &diagnosticError) {
+			printDiagnostics(settings.DiagnosticFormat, diagnosticError.Diagnostics)
+		}
+		return nil, err
+	}
+
+	printDiagnostics(settings.DiagnosticFormat, context.GetDiagnostics())
+
+	log("Took %dms to parse %d files\n", elapsedMilliseconds(startTime), context.GetCombinedFileCount())
+	return context, nil
+}
+
+/*
+	Prints the given [diagnostics] to stderr, either compiler-style ('text'), or as one JSON object per line ('json').
+	Each set of diagnostics is written at once, so that those of targets built in parallel aren't interleaved.
+*/
+func printDiagnostics(format string, diagnostics []coiler.Diagnostic) {
+
+	var output strings.Builder
+	var encoded []byte
+
+	for _, diagnostic := range diagnostics {
+
+		if format == "json" {
+
+			encoded, _ = json.Marshal(diagnostic)
+			output.Write(encoded)
+			output.WriteString("\n")
+			continue
+		}
+
+		output.WriteString(diagnostic.String())
+	}
+
+	if output.Len() > 0 {
+		os.Stderr.WriteString(output.String())
+	}
+}
+
+/*
+	Parses and compiles every target given in [settings] to its output path,
+	and creates native executables if requested. Targets are built in parallel.
+*/
+func build(settings RunSettings) {
+
+	var session *coiler.BuildSession
+	var errors []error
+
+	if settings.Watch {
+		watch(settings)
+		return
+	}
+
+	session = newSession(settings)
+	_, errors = buildTargets(settings, session, settings.Targets, true)
+	session.Close()
+
+	for i, err := range errors {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nUnable to build '%s': \n%v\n", settings.Targets[i].EntryPointPath, err)
+		}
+	}
+
+	for _, err := range errors {
+		if err != nil {
+			os.Exit(1)
+		}
+	}
+}
+
+/*
+	Builds each of the given [targets] in parallel.
+	Returns the context and error of each target, in the same order as [targets].
+*/
+func buildTargets(settings RunSettings, session *coiler.BuildSession, targets []BuildTarget, verbose bool) ([]*coiler.BuildContext, []error) {
+
+	var waitGroup sync.WaitGroup
+	var contexts []*coiler.BuildContext
+	var errors []error
+	var log logger
+
+	contexts = make([]*coiler.BuildContext, len(targets))
+	errors = make([]error, len(targets))
+
+	for i, target := range targets {
+
+		switch {
+		case !verbose:
+			log = func(format string, args ...interface{}) {}
+		case len(targets) > 1:
+			log = newLogger(fmt.Sprintf("[%s] ", target.EntryPointPath))
+		default:
+			log = newLogger("")
+		}
+
+		waitGroup.Add(1)
+		go func(index int, target BuildTarget, log logger) {
+
+			defer waitGroup.Done()
+			contexts[index], errors[index] = buildTarget(settings, session, target, log)
+		}(i, target, log)
+	}
+
+	waitGroup.Wait()
+	return contexts, errors
+}
+
+func buildTarget(settings RunSettings, session *coiler.BuildSession, target BuildTarget, log logger) (*coiler.BuildContext, error) {
+
+	var context *coiler.BuildContext
+	var err error
+
+	context, err = parseTarget(settings, session, target, log)
+	if err != nil {
+		return nil, err
+	}
+
+	return context, compileTarget(settings, target, context, log)
+}
+
+func compileTarget(settings RunSettings, target BuildTarget, context *coiler.BuildContext, log logger) error {
+
+	var binaryOptions coiler.BinaryOptions
+	var startTime time.Time
+	var err error
+
+	startTime = time.Now()
+
+	err = coiler.CompileCombinedFile(target.OutputPath, context)
+	if err != nil {
+		return err
+	}
+
+	log("Took %dms to compile\n", elapsedMilliseconds(startTime))
+
+	if !settings.ShouldCreateEmbedded {
+		return nil
+	}
+
+	startTime = time.Now()
+
+	binaryOptions = coiler.BinaryOptions{
+		Codec:            settings.PayloadCodec,
+		SigningKeyPath:   settings.SigningKeyPath,
+		RequireSignature: settings.RequireSignature,
+		Interpreter:      settings.Interpreter,
+	}
+
+	err = coiler.CreateBinary(target.OutputPath, binaryOptions)
+	if err != nil {
+		return err
+	}
+
+	log("Took %dms to create native binary\n", elapsedMilliseconds(startTime))
+	return nil
+}
+
+/*
+	Parses the entry point given in [settings] and reports what would be combined.
+*/
+func check(settings RunSettings) {
+
+	var session *coiler.BuildSession
+	var context *coiler.BuildContext
+
+	session = newSession(settings)
+	defer session.Close()
+
+	for _, target := range settings.Targets {
+
+		context = parse(settings, session, target)
+		reportTarget(target, context, len(settings.Targets) > 1)
+	}
+}
+
+func reportTarget(target BuildTarget, context *coiler.BuildContext, named bool) {
+
+	if named {
+		fmt.Printf("\n%s\n", target.EntryPointPath)
+	}
+
+	fmt.Printf("Combined modules:\n")
+	for _, file := range context.GetCombinedFiles() {
+		fmt.Printf("  %-20s %s\n", file.GetNamespace(), file.GetPath())
+	}
+
+	fmt.Printf("External modules:\n")
+	for _, module := range context.GetExternalDependencies() {
+		fmt.Printf("  %s\n", module)
+	}
+}
+
+/*
+	Parses the entry point given in [settings] and prints the dependencies of each combined module.
+*/
+func graph(settings RunSettings) {
+
+	var session *coiler.BuildSession
+	var context *coiler.BuildContext
+
+	session = newSession(settings)
+	defer session.Close()
+
+	for _, target := range settings.Targets {
+
+		context = parse(settings, session, target)
+		printGraph(settings.GraphFormat, context)
+	}
+}
+
+func printGraph(format string, context *coiler.BuildContext) {
+
+	switch format {
+	case "text":
+
+		for _, file := range context.GetCombinedFiles() {
+			fmt.Printf("%s: %s\n", file.GetNamespace(), strings.Join(file.GetDependencies(), " "))
+		}
+
+	case "dot":
+
+		fmt.Printf("digraph coiler {\n")
+		for _, file := range context.GetCombinedFiles() {
+
+			fmt.Printf("\t%q;\n", file.GetNamespace())
+			for _, dependency := range file.GetDependencies() {
+				fmt.Printf("\t%q -> %q;\n", file.GetNamespace(), dependency)
+			}
+		}
+		fmt.Printf("}\n")
+
+	default:
+		printError(2, "Unknown graph format '%s'\n", format)
+	}
+}
+
+/*
+	Builds the entry point given in [settings] to a temporary location, then runs it with the settings' program arguments.
+	Exits with the status of the application.
+*/
+func run(settings RunSettings) {
+
+	var session *coiler.BuildSession
+	var context *coiler.BuildContext
+	var target BuildTarget
+	var process *exec.Cmd
+	var outputDirectory, baseName, interpreter string
+	var err error
+
+	outputDirectory, err = ioutil.TempDir("", "coilerRun")
+	if err != nil {
+		printError(1, "Unable to create temporary output directory: \n%v\n", err)
 		return
 	}
+	defer os.RemoveAll(outputDirectory)
+
+	baseName = filepath.Base(settings.EntryPointPath)
+	baseName = strings.TrimSuffix(baseName, filepath.Ext(baseName))
+	settings.OutputPath = filepath.Join(outputDirectory, baseName+".pyc")
+
+	target = BuildTarget{EntryPointPath: settings.EntryPointPath, OutputPath: settings.OutputPath}
 
-	currentTime = time.Now()
-	elapsed = (currentTime.Unix() - startTime.Unix())
-	fmt.Printf("Took %dms to parse %d files\n", elapsed, context.GetCombinedFileCount())
+	// the combined output has everything it needs from the session, so the session is closed before it runs.
+	session = newSession(settings)
+	context = parse(settings, session, target)
+	err = compileTarget(settings, target, context, newLogger(""))
+	session.Close()
 
-	startTime = currentTime
-	err = coiler.CompileCombinedFile(settings.OutputPath, context)
 	if err != nil {
 		printError(1, "\nUnable to compile combined output: \n%v\n", err)
 		return
 	}
 
-	currentTime = time.Now()
-	elapsed = (currentTime.Unix() - startTime.Unix())
-	fmt.Printf("Took %dms to compile\n", elapsed)
+	if settings.ShouldCreateEmbedded {
+		process = exec.Command(strings.TrimSuffix(settings.OutputPath, ".pyc"), settings.ProgramArguments...)
+	} else {
 
-	if !settings.ShouldCreateEmbedded {
+		// modules which weren't combined are imported from the virtualenv at runtime, so it has to be its own interpreter that runs.
+		interpreter = settings.Interpreter
+		if settings.VirtualEnv != nil {
+			interpreter = settings.VirtualEnv.Interpreter
+		}
+		process = exec.Command(interpreter, append([]string{settings.OutputPath}, settings.ProgramArguments...)...)
+	}
+
+	process.Stdin = os.Stdin
+	process.Stdout = os.Stdout
+	process.Stderr = os.Stderr
+
+	err = process.Run()
+	if err != nil {
+
+		os.RemoveAll(outputDirectory)
+
+		if exitError, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitError.ExitCode())
+		}
+		printError(1, "Unable to run application: \n%v\n", err)
+	}
+}
+
+/*
+	Checks the signature of a native executable, exiting with a non-zero status if it is invalid.
+*/
+func verify(settings RunSettings) {
+
+	var key ed25519.PublicKey
+	var err error
+
+	if settings.VerificationKeyPath == "" {
+		printError(2, "Usage: coiler verify -k <public key> <binary>\n")
+		return
+	}
+
+	key, err = coiler.LoadVerificationKey(settings.VerificationKeyPath)
+	if err != nil {
+		printError(1, "Unable to load verification key: \n%v\n", err)
 		return
 	}
 
-	startTime = currentTime
+	err = coiler.VerifyBinary(settings.TargetPath, key)
+	if err != nil {
+		printError(1, "%s: %v\n", settings.TargetPath, err)
+		return
+	}
+
+	fmt.Printf("%s: signature OK\n", settings.TargetPath)
+}
+
+func inspect(settings RunSettings) {
+
+	var inspection *coiler.Inspection
+	var footer *coiler.PayloadFooter
+	var manifest *coiler.BuildManifest
+	var err error
 
-	err = coiler.CreateBinary(settings.OutputPath)
+	inspection, err = coiler.Inspect(settings.TargetPath)
 	if err != nil {
-		printError(1, "\nUnable to create native binary: \n%v\n", err)
+		printError(1, "Unable to inspect '%s': \n%v\n", settings.TargetPath, err)
+		return
+	}
+
+	fmt.Printf("File:            %s\n", inspection.Path)
+
+	if inspection.IsBinary {
+
+		footer = inspection.Footer
+		fmt.Printf("Type:            native executable\n")
+		fmt.Printf("Payload offset:  %d\n", footer.Offset)
+		fmt.Printf("Payload size:    %d bytes stored, %d bytes uncompressed\n", footer.StoredSize, footer.Size)
+		fmt.Printf("Payload codec:   %s\n", coiler.CodecName(footer.Codec))
+		fmt.Printf("Signed:          %v\n", footer.IsSigned())
+	} else {
+		fmt.Printf("Type:            compiled python\n")
+	}
+
+	fmt.Printf("Python magic:    %d (python %s)\n", inspection.Magic, inspection.PythonVersion)
+
+	manifest = inspection.Manifest
+	if manifest == nil {
+		fmt.Printf("Manifest:        %v\n", inspection.ManifestError)
 		return
 	}
 
-	currentTime = time.Now()
-	elapsed = (currentTime.Unix() - startTime.Unix())
-	fmt.Printf("Took %dms to create native binary\n", elapsed)
+	fmt.Printf("Built by:        coiler %s\n", manifest.CoilerVersion)
+	fmt.Printf("Entry point:     %s\n", manifest.EntryPoint)
+	fmt.Printf("Combined modules:\n")
+
+	for _, module := range manifest.Modules {
+		fmt.Printf("  %-20s sha256:%s  %s\n", module.Name, module.Hash, module.Path)
+	}
+
+	if len(manifest.External) > 0 {
+		fmt.Printf("External modules:\n")
+		for _, module := range manifest.External {
+			fmt.Printf("  %s\n", module)
+		}
+	}
 }
 
 func printError(status int, format string, args ...interface{}) {
@@ -61,3 +489,19 @@ func printError(status int, format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, format, args...)
 	os.Exit(status)
 }
+
+/*
+	Prints progress messages, prefixed so that the messages of parallel builds can be told apart.
+*/
+type logger func(format string, args ...interface{})
+
+func newLogger(prefix string) logger {
+
+	return func(format string, args ...interface{}) {
+		fmt.Printf(prefix+format, args...)
+	}
+}
+
+func elapsedMilliseconds(startTime time.Time) int64 {
+	return int64(time.Since(startTime) / time.Millisecond)
+}
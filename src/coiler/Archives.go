@@ -0,0 +1,147 @@
+package coiler
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Finds every module provided by the zip archive at (or containing) the given lookup [path].
+	As with zipimport, the path may name a directory within the archive ('/path/to/archive.zip/lib').
+	Modules are given paths within the archive ('/path/to/archive.zip/lib/module.py'), which readSourceFile can read.
+	Extension modules can't be imported from an archive, so they're ignored.
+*/
+func findArchiveModules(path string) (*lookupProviders, error) {
+
+	var ret *lookupProviders
+	var reader *zip.ReadCloser
+	var archive, prefix, name, module string
+	var err error
+
+	archive, prefix = splitArchivePath(path)
+	if archive == "" {
+
+		errorMsg := fmt.Sprintf("'%s' isn't a directory or within a zip archive", path)
+		return nil, errors.New(errorMsg)
+	}
+
+	archive, err = filepath.Abs(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err = zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	ret = newLookupProviders()
+
+	for _, file := range reader.File {
+
+		if !strings.HasPrefix(file.Name, prefix) {
+			continue
+		}
+		name = file.Name[len(prefix):]
+
+		// packages are only found by their '__init__.py', since archives needn't have entries for their directories.
+		module = strings.TrimSuffix(name, "/__init__.py")
+		if module != name && moduleNameRegex.MatchString(module) {
+
+			ret.add(module, filepath.Join(archive, filepath.FromSlash(prefix+module)), LOOKUP_PACKAGE)
+			continue
+		}
+
+		module = strings.TrimSuffix(name, ".py")
+		if module != name && moduleNameRegex.MatchString(module) {
+			ret.add(module, filepath.Join(archive, filepath.FromSlash(file.Name)), LOOKUP_SOURCE)
+		}
+	}
+	return ret, nil
+}
+
+/*
+	Splits the given [path] into the archive file which contains it, and the path within that archive (using '/' separators).
+	Returns an empty archive if no part of the path is a file.
+*/
+func splitArchivePath(path string) (string, string) {
+
+	var archive, inner, parent string
+	var info os.FileInfo
+	var err error
+
+	archive = filepath.Clean(path)
+
+	for {
+
+		info, err = os.Stat(archive)
+		if err == nil {
+
+			if info.Mode().IsRegular() {
+				return archive, inner
+			}
+			return "", ""
+		}
+
+		parent = filepath.Dir(archive)
+		if parent == archive {
+			return "", ""
+		}
+
+		inner = strings.TrimSuffix(filepath.Base(archive)+"/"+inner, "/")
+		archive = parent
+	}
+}
+
+/*
+	Reads the source file at the given [path], which may be within a zip archive ('/path/to/archive.zip/module.py').
+*/
+func readSourceFile(path string) ([]byte, error) {
+
+	var reader *zip.ReadCloser
+	var contents []byte
+	var archive, inner string
+	var err, archiveErr error
+
+	contents, err = ioutil.ReadFile(path)
+	if err == nil {
+		return contents, nil
+	}
+
+	archive, inner = splitArchivePath(path)
+	if archive == "" || inner == "" {
+		return nil, err
+	}
+
+	reader, archiveErr = zip.OpenReader(archive)
+	if archiveErr != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	for _, file := range reader.File {
+
+		if file.Name != inner {
+			continue
+		}
+
+		source, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer source.Close()
+
+		return ioutil.ReadAll(source)
+	}
+	return nil, err
+}
@@ -3,9 +3,14 @@ package coiler
 /*
 	Handles the compilation to a binary embedded executable.
 	This is accomplished by writing a bootstrap program which runs a python interpreter,
-	taking the source for that interpreter from the same file as the executable (the pyc code is appendedto the end of the executable)
+	taking the source for that interpreter from the same file as the executable (the pyc code is appended to the end of the executable,
+	followed by a footer which describes where it is and how it was compressed)
 */
 import (
+	"bytes"
+	"compress/zlib"
+	"crypto/ed25519"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -18,137 +23,464 @@ import (
 
 const (
 	EMBEDDED_SOURCE = `
+#include <Python.h>
+#include <marshal.h>
 #include <stdio.h>
 #include <stdlib.h>
 #include <string.h>
-#include <Python.h>
+#include <limits.h>
+#include <zlib.h>
+#ifdef COILER_ZSTD
+#include <zstd.h>
+#endif
+#ifdef COILER_VERIFY
+#include <openssl/evp.h>
+#endif
+
+#define FOOTER_SIZE 96
+#define SIGNATURE_SIZE 64
+#define CODEC_NONE 0
+#define CODEC_ZLIB 1
+#define CODEC_ZSTD 2
+
+/*
+	Reads a little-endian unsigned 64-bit integer from the given buffer.
+*/
+unsigned long long readUint64(const unsigned char* buffer)
+{
+	unsigned long long ret;
 
-int memsearch(const char *hay, int haysize, const char *needle, int needlesize) {
-    int haypos, needlepos;
-    haysize -= needlesize;
-    for (haypos = 0; haypos <= haysize; haypos++) {
-        for (needlepos = 0; needlepos < needlesize; needlepos++) {
-            if (hay[haypos + needlepos] != needle[needlepos]) {
-                // Next character in haystack.
-                break;
-            }
-        }
-        if (needlepos == needlesize) {
-            return haypos;
-        }
-    }
-    return -1;
+	ret = 0;
+	for(int i = 7; i >= 0; i--)
+		ret = (ret << 8) | buffer[i];
+	return ret;
 }
 
+#ifdef COILER_VERIFY
 /*
-	Searches for the magic string, returning the byte offset at which data can be read after the magic string.
-	-1 indicates no magic string found.
+	Checks the signature at the end of the given [executable] against the public key that this bootstrap was compiled with.
+	The signature covers every byte of the executable which precedes it.
+	Returns 0 if the signature is valid.
 */
-long extractPYC(FILE* sourceFile)
+int verifySignature(FILE* executable)
 {
-	char buffer[256];
-	char searchString[30];
-	size_t subIndex;
-	size_t frontBuffer;
-	long offset;
-	int bytesRead;
-
-	frontBuffer = buffer + 128;
-	subIndex = -1;
-	offset = 0;
-
-	// form the magic string to search for.
-	for(int i = 0; i < 23; i++)
-		searchString[i] = '\0';
-	memcpy(searchString + 23, "COILER:", 7);
-
-	while(1)
+	EVP_PKEY* key;
+	EVP_MD_CTX* context;
+	unsigned char* contents;
+	long size;
+	int valid;
+
+	if(fseek(executable, 0, SEEK_END) != 0)
+		return 1;
+
+	size = ftell(executable);
+	if(size < FOOTER_SIZE)
+		return 1;
+
+	contents = malloc(size);
+	if(contents == NULL)
+		return 1;
+
+	if(fseek(executable, 0, SEEK_SET) != 0 || fread(contents, 1, size, executable) != (size_t)size)
 	{
-		// move front half to the back
-		memcpy(buffer, frontBuffer, 128);
+		free(contents);
+		return 1;
+	}
 
-		// read data to front
-		bytesRead = fread(frontBuffer, 1, 128, sourceFile);
+	valid = 0;
+	key = EVP_PKEY_new_raw_public_key(EVP_PKEY_ED25519, NULL, COILER_PUBLIC_KEY, sizeof(COILER_PUBLIC_KEY));
+	context = EVP_MD_CTX_new();
 
-		// eof?
-		if(bytesRead <= 0)
-			break;
+	if(key != NULL && context != NULL && EVP_DigestVerifyInit(context, NULL, NULL, NULL, key) == 1)
+		valid = EVP_DigestVerify(context, contents + size - SIGNATURE_SIZE, SIGNATURE_SIZE, contents, size - SIGNATURE_SIZE) == 1;
+
+	EVP_MD_CTX_free(context);
+	EVP_PKEY_free(key);
+	free(contents);
+	return valid ? 0 : 1;
+}
+#endif
+
+/*
+	Reads the footer at the end of the given [executable], then reads and decompresses the payload it describes.
+	Returns the decompressed payload (which the caller must free), or NULL on failure.
+*/
+char* extractPYC(FILE* executable, size_t* payloadSize)
+{
+	unsigned char footer[FOOTER_SIZE];
+	char* stored;
+	char* payload;
+	unsigned long long offset, storedSize, size;
+	int codec;
+
+	if(fseek(executable, -FOOTER_SIZE, SEEK_END) != 0 || fread(footer, 1, FOOTER_SIZE, executable) != FOOTER_SIZE)
+		return NULL;
+
+	if(memcmp(footer, "COILER:", 7) != 0)
+		return NULL;
+
+	codec = footer[7];
+	offset = readUint64(footer + 8);
+	storedSize = readUint64(footer + 16);
+	size = readUint64(footer + 24);
+
+	stored = malloc(storedSize);
+	if(stored == NULL)
+		return NULL;
+
+	if(fseek(executable, offset, SEEK_SET) != 0 || fread(stored, 1, storedSize, executable) != storedSize)
+	{
+		free(stored);
+		return NULL;
+	}
+
+	if(codec == CODEC_NONE)
+	{
+		*payloadSize = storedSize;
+		return stored;
+	}
 
-		subIndex = memsearch(buffer, 256, searchString, 30);
-		if(subIndex != -1)
+	payload = malloc(size);
+	if(payload == NULL)
+	{
+		free(stored);
+		return NULL;
+	}
+
+	switch(codec)
+	{
+		case CODEC_ZLIB:
 		{
-			offset += subIndex - 128;
-			return offset;
+			uLongf decompressedSize = size;
+			if(uncompress((Bytef*)payload, &decompressedSize, (Bytef*)stored, storedSize) != Z_OK || decompressedSize != size)
+			{
+				free(payload);
+				payload = NULL;
+			}
+			break;
+		}
+#ifdef COILER_ZSTD
+		case CODEC_ZSTD:
+		{
+			size_t decompressedSize = ZSTD_decompress(payload, size, stored, storedSize);
+			if(ZSTD_isError(decompressedSize) || decompressedSize != size)
+			{
+				free(payload);
+				payload = NULL;
+			}
+			break;
 		}
+#endif
+		default:
+			fprintf(stderr, "Unsupported payload codec %d\n", codec);
+			free(payload);
+			payload = NULL;
+	}
+
+	free(stored);
+	*payloadSize = size;
+	return payload;
+}
+
+/*
+	Returns the size of the header which precedes the marshalled code object in a pyc file,
+	for the version of python that this bootstrap was compiled against.
+*/
+size_t pycHeaderSize()
+{
+#if PY_VERSION_HEX >= 0x03070000
+	// magic, flags, timestamp or hash (8 bytes), source size
+	return 16;
+#elif PY_VERSION_HEX >= 0x03030000
+	// magic, timestamp, source size
+	return 12;
+#else
+	// magic, timestamp
+	return 8;
+#endif
+}
+
+/*
+	Checks that the magic number at the start of the given pyc [payload] matches the magic number of the linked libpython.
+	Returns 0 if they match.
+*/
+int checkMagic(const unsigned char* payload)
+{
+	long expected, found;
+
+	expected = PyImport_GetMagicNumber();
+	found = payload[0] | (payload[1] << 8) | (payload[2] << 16) | ((long)payload[3] << 24);
+
+	if(found == expected)
+		return 0;
+
+	fprintf(stderr, "Embedded application was compiled for a different version of python than this executable was linked against (bytecode magic %ld, expected %ld for python %s)\n",
+		found & 0xFFFF, expected & 0xFFFF, PY_VERSION);
+	return 1;
+}
+
+/*
+	Creates a new '__main__' module (replacing the one created by the interpreter) whose '__file__' is the given [path].
+	Returns the globals of that module, or NULL on failure.
+*/
+PyObject* createMainModule(const char* path)
+{
+	PyObject* module;
+	PyObject* globals;
+	PyObject* file;
+
+	module = PyModule_New("__main__");
+	if(module == NULL)
+		return NULL;
+
+	if(PyDict_SetItemString(PyImport_GetModuleDict(), "__main__", module) != 0)
+	{
+		Py_DECREF(module);
+		return NULL;
+	}
+
+	// the module dictionary now holds a reference, which keeps the globals alive.
+	globals = PyModule_GetDict(module);
+	Py_DECREF(module);
+
+#if PY_MAJOR_VERSION >= 3
+	file = PyUnicode_DecodeFSDefault(path);
+#else
+	file = PyString_FromString(path);
+#endif
+	if(file == NULL)
+		return NULL;
+
+	if(PyDict_SetItemString(globals, "__file__", file) != 0 ||
+		PyDict_SetItemString(globals, "__builtins__", PyEval_GetBuiltins()) != 0)
+	{
+		Py_DECREF(file);
+		return NULL;
+	}
+
+	Py_DECREF(file);
+	return globals;
+}
+
+/*
+	Runs the given marshalled [code] object as the '__main__' module.
+	Returns the process exit status.
+*/
+int runCode(PyObject* code, const char* path)
+{
+	PyObject* globals;
+	PyObject* result;
+
+	globals = createMainModule(path);
+	if(globals == NULL)
+	{
+		PyErr_Print();
+		return 1;
+	}
 
-		offset += bytesRead;
+#if PY_MAJOR_VERSION >= 3
+	result = PyEval_EvalCode(code, globals, globals);
+#else
+	result = PyEval_EvalCode((PyCodeObject*)code, globals, globals);
+#endif
+
+	if(result == NULL)
+	{
+		// SystemExit is handled (and the process exited) by PyErr_Print.
+		PyErr_Print();
+		return 1;
 	}
 
-	return -1;
+	Py_DECREF(result);
+	return 0;
 }
 
-char *gnu_basename(char *path)
+/*
+	Passes the program name and arguments to the interpreter, then initializes it.
+*/
+void initializePython(int argc, char** argv)
 {
-    char *base = strrchr(path, '/');
-    return base ? base+1 : path;
+#if PY_MAJOR_VERSION >= 3
+	wchar_t** arguments;
+
+	arguments = malloc(sizeof(wchar_t*) * argc);
+	for(int i = 0; i < argc; i++)
+		arguments[i] = Py_DecodeLocale(argv[i], NULL);
+
+	Py_SetProgramName(arguments[0]);
+	Py_Initialize();
+	PySys_SetArgvEx(argc, arguments, 0);
+#else
+	Py_SetProgramName(argv[0]);
+	Py_Initialize();
+	PySys_SetArgvEx(argc, argv, 0);
+#endif
 }
 
-int main(const int arc, const char** argv)
+int main(int argc, char** argv)
 {
 	FILE* executable;
-	long applicationOffset;
+	PyObject* code;
+	char path[PATH_MAX];
+	char* payload;
+	size_t payloadSize, headerSize;
 	int status;
 
-	executable = fopen(argv[0], "r");
+	// prefer the kernel's idea of where this executable lives, since argv[0] may not be a path.
+	if(realpath("/proc/self/exe", path) == NULL && realpath(argv[0], path) == NULL)
+	{
+		strncpy(path, argv[0], PATH_MAX - 1);
+		path[PATH_MAX - 1] = '\0';
+	}
+
+	executable = fopen(path, "rb");
 	if(executable == 0)
 	{
-		printf("Unable to read own executable\n");
+		fprintf(stderr, "Unable to read own executable\n");
 		return 1;
 	}
 
-	applicationOffset = extractPYC(executable);
+#ifdef COILER_VERIFY
+	if(verifySignature(executable) != 0)
+	{
+		fprintf(stderr, "Embedded application signature is invalid, refusing to run\n");
+		fclose(executable);
+		return 1;
+	}
+#endif
+
+	payload = extractPYC(executable, &payloadSize);
 	fclose(executable);
 
-	if(applicationOffset < 0)
+	headerSize = pycHeaderSize();
+	if(payload == NULL || payloadSize < headerSize)
 	{
-		printf("Unable to find PYC application code\n");
+		fprintf(stderr, "Unable to find PYC application code\n");
 		return 1;
 	}
 
-	executable = fopen(argv[0], "r");
-	status = fseek(executable, applicationOffset, 0);
-	if(status != 0)
+	initializePython(argc, argv);
+
+	if(checkMagic((unsigned char*)payload) != 0)
 	{
-		printf("Unable to skip to pyc application\n");
+		free(payload);
+		Py_Finalize();
 		return 1;
 	}
 
-	Py_SetProgramName(argv[0]);
-	Py_Initialize();
-	status = PyRun_SimpleFile(executable, gnu_basename(argv[0]));
+	code = PyMarshal_ReadObjectFromString(payload + headerSize, payloadSize - headerSize);
+	free(payload);
+
+	if(code == NULL || !PyCode_Check(code))
+	{
+		if(code == NULL)
+			PyErr_Print();
+		else
+			fprintf(stderr, "Embedded application does not contain a code object\n");
+
+		Py_XDECREF(code);
+		Py_Finalize();
+		return 1;
+	}
+
+	status = runCode(code, path);
+	Py_DECREF(code);
+
 	Py_Finalize();
 	return status;
 }
 `
 
 	MAGIC_STRING = "COILER:"
+
+	// the size, in bytes, of the footer written after an embedded payload.
+	// The last SIGNATURE_SIZE bytes of the footer are the payload signature (or zeroes, if the binary is unsigned).
+	FOOTER_SIZE    = 96
+	SIGNATURE_SIZE = ed25519.SignatureSize
 )
 
-var NUL_ENTRIES = []byte{
-	0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0,
-	0, 0, 0,
+/*
+	Identifies the compression used for an embedded payload. Stored in the footer so that the bootstrap knows how to decompress it.
+*/
+const (
+	CODEC_NONE byte = iota
+	CODEC_ZLIB
+	CODEC_ZSTD
+)
+
+const (
+	// compiled to check that the zstd library the bootstrap decompresses with is available.
+	ZSTD_CHECK_SOURCE = `
+#include <zstd.h>
+
+int main()
+{
+	return ZSTD_versionNumber() > 0 ? 0 : 1;
+}
+`
+)
+
+/*
+	Describes the payload of a native executable, as read from its footer.
+*/
+type PayloadFooter struct {
+	Codec      byte
+	Offset     uint64
+	StoredSize uint64
+	Size       uint64
+	Signature  []byte
+}
+
+/*
+	Options which control how a native executable is built.
+*/
+type BinaryOptions struct {
+
+	// The name of the compression used for the payload; "none", "zlib", or "zstd".
+	Codec string
+
+	// Path to a PEM-encoded Ed25519 private key used to sign the payload. If empty, the binary is not signed.
+	SigningKeyPath string
+
+	// If true, the bootstrap refuses to run a payload whose signature does not match the signing key.
+	RequireSignature bool
+
+	// The python interpreter whose libpython is embedded. Its '-config' tool must be available. Defaults to "python".
+	Interpreter string
 }
 
-func CreateBinary(sourcePath string) error {
+/*
+	Creates a native executable next to the given [sourcePath] which runs the compiled python at that path.
+*/
+func CreateBinary(sourcePath string, options BinaryOptions) error {
 
 	var compiledPath string
 	var precompiledPath string
 	var baseName string
+	var prelude string
+	var key ed25519.PrivateKey
+	var codec byte
 	var err error
 
+	codec, err = parseCodec(options.Codec)
+	if err != nil {
+		return err
+	}
+
+	if options.SigningKeyPath != "" {
+
+		key, err = LoadSigningKey(options.SigningKeyPath)
+		if err != nil {
+			return err
+		}
+
+		if options.RequireSignature {
+			prelude = verificationPrelude(key.Public().(ed25519.PublicKey))
+		}
+	} else if options.RequireSignature {
+		return errors.New("A signing key is required in order to make the binary verify its own signature")
+	}
+
 	precompiledPath, err = ioutil.TempDir("", "coilerEmbedded")
 	if err != nil {
 		return err
@@ -166,64 +498,145 @@ func CreateBinary(sourcePath string) error {
 	compiledPath = filepath.Dir(compiledPath)
 	compiledPath = filepath.Join(compiledPath, baseName)
 
-	err = writeEmbeddedSource(precompiledPath)
+	err = writeEmbeddedSource(precompiledPath, prelude)
 	if err != nil {
 		return err
 	}
 
-	err = compileEmbedded(precompiledPath, compiledPath)
+	if options.Interpreter == "" {
+		options.Interpreter = "python"
+	}
+
+	err = compileEmbedded(options.Interpreter+"-config", precompiledPath, compiledPath, codec, options.RequireSignature)
 	if err != nil {
 		return err
 	}
 
-	err = appendApplication(sourcePath, compiledPath)
+	err = appendApplication(sourcePath, compiledPath, codec, key)
 	return err
 }
 
-func writeEmbeddedSource(target string) error {
+/*
+	Translates a user-facing codec name into the identifier stored in a payload footer.
+	zstd is only available if the 'zstd' tool can be found locally, since it is used to compress the payload,
+	and if the zstd library (and its headers) can be compiled against, since the bootstrap uses it to decompress the payload.
+*/
+func parseCodec(name string) (byte, error) {
+
+	var err error
+
+	switch name {
+	case "", "zlib":
+		return CODEC_ZLIB, nil
+	case "none":
+		return CODEC_NONE, nil
+	case "zstd":
+		_, err = exec.LookPath("zstd")
+		if err != nil {
+			return 0, errors.New("Unable to use zstd payload compression, no local 'zstd' tool could be found")
+		}
+
+		err = checkZstdLibrary()
+		if err != nil {
+			errorMsg := fmt.Sprintf("Unable to use zstd payload compression, the zstd library and its headers ('zstd.h', '-lzstd') aren't available to gcc:\n%v", err)
+			return 0, errors.New(errorMsg)
+		}
+		return CODEC_ZSTD, nil
+	}
+
+	errorMsg := fmt.Sprintf("Unknown payload codec '%s', expected one of 'none', 'zlib', 'zstd'", name)
+	return 0, errors.New(errorMsg)
+}
+
+/*
+	Compiles a tiny program against 'zstd.h' and '-lzstd', the way the bootstrap is compiled when it decompresses zstd payloads.
+	Returns an error (including the compiler's output) if it can't be built.
+*/
+func checkZstdLibrary() error {
 
-	err := ioutil.WriteFile(target, []byte(EMBEDDED_SOURCE), 0644)
+	var compiler *exec.Cmd
+	var directory, sourcePath string
+	var rawOutput []byte
+	var err error
+
+	directory, err = ioutil.TempDir("", "coilerZstd")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(directory)
+
+	sourcePath = filepath.Join(directory, "check.c")
+
+	err = ioutil.WriteFile(sourcePath, []byte(ZSTD_CHECK_SOURCE), 0644)
+	if err != nil {
+		return err
+	}
+
+	compiler = exec.Command("gcc", sourcePath, "-o", filepath.Join(directory, "check"), "-lzstd")
+	rawOutput, err = compiler.CombinedOutput()
+
+	if err != nil {
+		errorMsg := fmt.Sprintf("%v\n%v", err.Error(), string(rawOutput))
+		return errors.New(errorMsg)
+	}
+	return nil
+}
+
+/*
+	Writes the bootstrap source to the given [target], preceded by the given [prelude] (which may define compile-time options).
+*/
+func writeEmbeddedSource(target string, prelude string) error {
+
+	err := ioutil.WriteFile(target, []byte(prelude+EMBEDDED_SOURCE), 0644)
 	return err
 }
 
-func compileEmbedded(sourcePath string, targetPath string) error {
+func compileEmbedded(configTool string, sourcePath string, targetPath string, codec byte, verify bool) error {
 
 	var compiler *exec.Cmd
 	var arguments []string
 	var rawOutput []byte
-	var output string
 	var err error
 
 	// first, call pythonX.Y-config to get list of includes needed into order to embed python
-	compiler = exec.Command("python2.7-config", "--cflags")
+	compiler = exec.Command(configTool, "--cflags")
 	rawOutput, err = compiler.Output()
 
 	if err != nil {
 		errorMsg := fmt.Sprintf("%v\n%v\n", err.Error(), string(rawOutput))
 		return errors.New(errorMsg)
 	}
-	output = string(rawOutput)
-	output = strings.Replace(output, "\n", "", -1)
-	output = strings.Replace(output, "  ", " ", -1)
-	arguments = strings.Split(output, " ")
+	arguments = strings.Fields(string(rawOutput))
 
 	// set up output
 	arguments = append(arguments, "-o")
 	arguments = append(arguments, targetPath)
 	arguments = append(arguments, sourcePath)
 
-	// linker arguments
-	compiler = exec.Command("python2.7-config", "--ldflags")
+	// linker arguments. Python 3.8 and later only include libpython when asked for an embedding,
+	// but older versions don't understand the flag.
+	compiler = exec.Command(configTool, "--ldflags", "--embed")
 	rawOutput, err = compiler.Output()
 
+	if err != nil {
+		compiler = exec.Command(configTool, "--ldflags")
+		rawOutput, err = compiler.Output()
+	}
+
 	if err != nil {
 		errorMsg := fmt.Sprintf("%v\n%v\n", err.Error(), string(rawOutput))
 		return errors.New(errorMsg)
 	}
-	output = string(rawOutput)
-	output = strings.Replace(output, "\n", "", -1)
-	output = strings.Replace(output, "  ", " ", -1)
-	arguments = append(arguments, strings.Split(output, " ")...)
+	arguments = append(arguments, strings.Fields(string(rawOutput))...)
+	arguments = append(arguments, "-lz")
+
+	if codec == CODEC_ZSTD {
+		arguments = append(arguments, "-DCOILER_ZSTD", "-lzstd")
+	}
+
+	if verify {
+		arguments = append(arguments, "-lcrypto")
+	}
 
 	compiler = exec.Command("gcc", arguments...)
 	rawOutput, err = compiler.CombinedOutput()
@@ -237,29 +650,184 @@ func compileEmbedded(sourcePath string, targetPath string) error {
 }
 
 /*
-	Appends the *.pyc code at the given [source] to the end of the given [target].
-	But first, appends 23 NUL characters followed by a magic string (as identifiers).
+	Appends the *.pyc code at the given [source] to the end of the given [target], compressed with the given [codec].
+	Then appends a footer which identifies the codec, as well as the offset and sizes of the payload.
+	If a [key] is given, the footer ends with a signature of everything before it.
 */
-func appendApplication(source string, target string) error {
+func appendApplication(source string, target string, codec byte, key ed25519.PrivateKey) error {
 
-	var sourceFile, targetFile *os.File
+	var targetFile *os.File
+	var info os.FileInfo
+	var payload, stored, footer, signature []byte
 	var err error
 
+	payload, err = ioutil.ReadFile(source)
+	if err != nil {
+		return err
+	}
+
+	stored, err = compressPayload(payload, codec)
+	if err != nil {
+		return err
+	}
+
 	targetFile, err = os.OpenFile(target, os.O_APPEND|os.O_WRONLY, 0755)
 	if err != nil {
 		return err
 	}
 	defer targetFile.Close()
 
-	sourceFile, err = os.Open(source)
+	info, err = targetFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	footer = make([]byte, FOOTER_SIZE)
+	copy(footer, MAGIC_STRING)
+	footer[len(MAGIC_STRING)] = codec
+	binary.LittleEndian.PutUint64(footer[8:], uint64(info.Size()))
+	binary.LittleEndian.PutUint64(footer[16:], uint64(len(stored)))
+	binary.LittleEndian.PutUint64(footer[24:], uint64(len(payload)))
+
+	_, err = targetFile.Write(stored)
+	if err != nil {
+		return err
+	}
+
+	_, err = targetFile.Write(footer[:FOOTER_SIZE-SIGNATURE_SIZE])
 	if err != nil {
 		return err
 	}
-	defer sourceFile.Close()
 
-	targetFile.Write(NUL_ENTRIES)
-	targetFile.WriteString(MAGIC_STRING)
+	if key != nil {
 
-	_, err = io.Copy(targetFile, sourceFile)
+		signature, err = signFile(target, key)
+		if err != nil {
+			return err
+		}
+		copy(footer[FOOTER_SIZE-SIGNATURE_SIZE:], signature)
+	}
+
+	_, err = targetFile.Write(footer[FOOTER_SIZE-SIGNATURE_SIZE:])
 	return err
 }
+
+func compressPayload(payload []byte, codec byte) ([]byte, error) {
+
+	var buffer bytes.Buffer
+	var writer *zlib.Writer
+	var compressor *exec.Cmd
+	var err error
+
+	switch codec {
+	case CODEC_NONE:
+		return payload, nil
+
+	case CODEC_ZLIB:
+		writer, err = zlib.NewWriterLevel(&buffer, zlib.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = writer.Write(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		err = writer.Close()
+		return buffer.Bytes(), err
+
+	case CODEC_ZSTD:
+		compressor = exec.Command("zstd", "-q", "-19", "-c")
+		compressor.Stdin = bytes.NewReader(payload)
+		return compressor.Output()
+	}
+
+	return nil, errors.New("Unknown payload codec")
+}
+
+/*
+	Reads the payload footer from the end of the given executable [contents].
+*/
+func readPayloadFooter(contents []byte) (*PayloadFooter, error) {
+
+	var ret *PayloadFooter
+	var footer []byte
+	var limit uint64
+
+	if len(contents) < FOOTER_SIZE {
+		return nil, errors.New("File is too small to be a coiled binary")
+	}
+
+	footer = contents[len(contents)-FOOTER_SIZE:]
+	if !bytes.HasPrefix(footer, []byte(MAGIC_STRING)) {
+		return nil, errors.New("File is not a coiled binary, no payload footer was found")
+	}
+
+	ret = new(PayloadFooter)
+	ret.Codec = footer[len(MAGIC_STRING)]
+	ret.Offset = binary.LittleEndian.Uint64(footer[8:])
+	ret.StoredSize = binary.LittleEndian.Uint64(footer[16:])
+	ret.Size = binary.LittleEndian.Uint64(footer[24:])
+	ret.Signature = footer[FOOTER_SIZE-SIGNATURE_SIZE:]
+
+	// the footer may have come from anywhere, so the bounds are checked in a way which can't overflow.
+	limit = uint64(len(contents) - FOOTER_SIZE)
+	if ret.Offset > limit || ret.StoredSize > limit-ret.Offset {
+		return nil, errors.New("Payload footer describes a payload outside of the file")
+	}
+	return ret, nil
+}
+
+func (this *PayloadFooter) IsSigned() bool {
+	return !bytes.Equal(this.Signature, make([]byte, SIGNATURE_SIZE))
+}
+
+/*
+	Returns the decompressed payload described by this footer, from the given executable [contents].
+*/
+func (this *PayloadFooter) ExtractPayload(contents []byte) ([]byte, error) {
+
+	var stored []byte
+	var reader io.ReadCloser
+	var decompressor *exec.Cmd
+	var err error
+
+	stored = contents[this.Offset : this.Offset+this.StoredSize]
+
+	switch this.Codec {
+	case CODEC_NONE:
+		return stored, nil
+
+	case CODEC_ZLIB:
+		reader, err = zlib.NewReader(bytes.NewReader(stored))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+
+	case CODEC_ZSTD:
+		decompressor = exec.Command("zstd", "-q", "-d", "-c")
+		decompressor.Stdin = bytes.NewReader(stored)
+		return decompressor.Output()
+	}
+
+	return nil, errors.New("Unknown payload codec")
+}
+
+/*
+	Returns the user-facing name of the given [codec].
+*/
+func CodecName(codec byte) string {
+
+	switch codec {
+	case CODEC_NONE:
+		return "none"
+	case CODEC_ZLIB:
+		return "zlib"
+	case CODEC_ZSTD:
+		return "zstd"
+	}
+	return fmt.Sprintf("unknown (%d)", codec)
+}
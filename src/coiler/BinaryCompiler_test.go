@@ -0,0 +1,61 @@
+package coiler
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+/*
+	Footers are read from binaries which may not have been made by coiler at all, so a malformed one must be rejected rather than trusted.
+*/
+func TestReadPayloadFooter(test *testing.T) {
+
+	var cases = []struct {
+		name       string
+		prefix     int
+		offset     uint64
+		storedSize uint64
+		valid      bool
+	}{
+		{"whole prefix", 32, 0, 32, true},
+		{"within prefix", 32, 8, 16, true},
+		{"empty payload at end", 32, 32, 0, true},
+		{"past the footer", 32, 8, 32, false},
+		{"offset past the footer", 32, 40, 0, false},
+		{"offset overflows", 16, 0xFFFFFFFFFFFFFFF0, 0x20, false},
+		{"size overflows", 16, 8, 0xFFFFFFFFFFFFFFFC, false},
+	}
+
+	for _, testCase := range cases {
+
+		contents := make([]byte, testCase.prefix+FOOTER_SIZE)
+		footer := contents[testCase.prefix:]
+
+		copy(footer, MAGIC_STRING)
+		footer[len(MAGIC_STRING)] = CODEC_NONE
+		binary.LittleEndian.PutUint64(footer[8:], testCase.offset)
+		binary.LittleEndian.PutUint64(footer[16:], testCase.storedSize)
+		binary.LittleEndian.PutUint64(footer[24:], testCase.storedSize)
+
+		parsed, err := readPayloadFooter(contents)
+		if (err == nil) != testCase.valid {
+			test.Errorf("%s: expected the footer to be valid (%v), got error %v", testCase.name, testCase.valid, err)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		payload, err := parsed.ExtractPayload(contents)
+		if err != nil || uint64(len(payload)) != testCase.storedSize {
+			test.Errorf("%s: expected a payload of %d bytes, got %d (%v)", testCase.name, testCase.storedSize, len(payload), err)
+		}
+	}
+
+	for _, contents := range [][]byte{make([]byte, FOOTER_SIZE-1), make([]byte, FOOTER_SIZE)} {
+		if _, err := readPayloadFooter(contents); err == nil {
+			test.Errorf("expected %d bytes without a footer to be rejected", len(contents))
+		}
+	}
+}
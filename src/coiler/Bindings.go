@@ -0,0 +1,780 @@
+package coiler
+
+import (
+	"regexp"
+	"strings"
+)
+
+/*
+	A single logical line of python source; one or more physical lines joined by brackets or backslashes.
+	String literals and comments are masked out (replaced by spaces), so that their contents are never mistaken for code.
+*/
+type logicalLine struct {
+
+	// the masked text of the line, including its indentation. Physical lines after the first are separated by newlines.
+	text string
+
+	// the (1-based) physical line that the logical line begins on
+	line int
+
+	// the width of the indentation before the line
+	indent int
+}
+
+/*
+	A compound statement whose body is indented on the lines that follow it.
+*/
+type openBlock struct {
+	indent int
+
+	// true for function and class bodies, whose bindings don't belong to the module.
+	isScope bool
+}
+
+var walrusRegex *regexp.Regexp
+var definitionRegex *regexp.Regexp
+var identifierRegex *regexp.Regexp
+var typeAliasRegex *regexp.Regexp
+
+// python's (hard) keywords, which can never be bound as names.
+var pythonKeywords map[string]bool
+
+func init() {
+
+	walrusRegex = regexp.MustCompile("\\b([a-zA-Z_][a-zA-Z0-9_]*)\\s*:=")
+	identifierRegex = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*")
+
+	// the name may be followed by PEP 695 type parameters ('def f[T](x: T)', 'class C[T]:') before its arguments or bases.
+	definitionRegex = regexp.MustCompile("^(?:def|class)\\s+([a-zA-Z_][a-zA-Z0-9_]*)\\s*[(\\[:]")
+
+	// a PEP 695 type alias ('type Number = int', 'type Pair[T] = tuple[T, T]'). 'type' is a soft keyword, and otherwise an ordinary name.
+	typeAliasRegex = regexp.MustCompile("^type\\s+([a-zA-Z_][a-zA-Z0-9_]*)\\s*[\\[=]")
+
+	pythonKeywords = make(map[string]bool)
+	for _, keyword := range strings.Fields("False None True and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield") {
+		pythonKeywords[keyword] = true
+	}
+}
+
+/*
+	Finds every name bound at the top level (module scope) of the given python [source], in the order they're first bound.
+	This is meant to match the names python's own 'symtable' considers assigned in the module, other than imports (which are handled separately).
+*/
+func findBindings(source string) []SymbolDefinition {
+
+	var ret []SymbolDefinition
+	var blocks []openBlock
+	var indexes map[string]int
+	var defined []int
+	var inScope, opensBlock, isScope bool
+	var bindings []SymbolDefinition
+	var statementEnd int
+
+	indexes = make(map[string]int)
+
+	// functions and classes are only (re)defined once the whole top-level statement containing them has run.
+	finishStatement := func() {
+
+		for _, index := range defined {
+			ret[index].Ends = append(ret[index].Ends, statementEnd)
+		}
+		defined = defined[:0]
+	}
+
+	for _, line := range readLogicalLines(source) {
+
+		if line.indent == 0 && !isClauseContinuation(line) {
+			finishStatement()
+		}
+		statementEnd = line.line + strings.Count(line.text, "\n")
+
+		for len(blocks) > 0 && line.indent <= blocks[len(blocks)-1].indent {
+			blocks = blocks[:len(blocks)-1]
+		}
+
+		inScope = false
+		for _, block := range blocks {
+			inScope = inScope || block.isScope
+		}
+
+		// nothing within a function or class binds names in the module. Blocks within it will be closed along with it.
+		if inScope {
+			continue
+		}
+
+		bindings, opensBlock, isScope = analyzeStatement(line)
+
+		for _, binding := range bindings {
+
+			index, found := indexes[binding.Name]
+			if !found {
+				index = len(ret)
+				indexes[binding.Name] = index
+				ret = append(ret, binding)
+			}
+
+			// a name is a definition if it's bound by a def or class anywhere, not just where it's first bound.
+			if binding.Definition {
+
+				ret[index].Definition = true
+				if !elementExistsInInts(index, defined) {
+					defined = append(defined, index)
+				}
+			}
+		}
+
+		if opensBlock {
+			blocks = append(blocks, openBlock{indent: line.indent, isScope: isScope})
+		}
+	}
+
+	finishStatement()
+	return ret
+}
+
+/*
+	Returns true if the given top-level [line] continues the compound statement before it, rather than starting a new one.
+*/
+func isClauseContinuation(line logicalLine) bool {
+
+	switch identifierRegex.FindString(line.text) {
+	case "else", "elif", "except", "finally":
+		return true
+	}
+	return false
+}
+
+func elementExistsInInts(element int, slice []int) bool {
+
+	for _, e := range slice {
+		if e == element {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Splits the given python [source] into logical lines, masking out string literals and comments.
+	Lines which are blank (or only a comment) are left out.
+*/
+func readLogicalLines(source string) []logicalLine {
+
+	var ret []logicalLine
+	var masked []byte
+	var depth, lineNumber, startLine, end, quoteLength int
+
+	lineNumber = 1
+	startLine = 1
+
+	flush := func() {
+
+		var text, trimmed string
+
+		text = string(masked)
+		trimmed = strings.TrimLeft(text, " \t\f")
+
+		if strings.TrimSpace(trimmed) != "" {
+			ret = append(ret, logicalLine{text: text, line: startLine, indent: len(text) - len(trimmed)})
+		}
+
+		masked = masked[:0]
+		startLine = lineNumber
+	}
+
+	for i := 0; i < len(source); {
+
+		character := source[i]
+
+		switch {
+		case character == '#':
+
+			for i < len(source) && source[i] != '\n' {
+				masked = append(masked, ' ')
+				i++
+			}
+
+		case character == '"' || character == '\'':
+
+			// keep the quotes, so that it's still clear there's an expression here.
+			end, quoteLength = skipString(source, i)
+
+			for j := i; j < end; j++ {
+
+				switch {
+				case source[j] == '\n':
+					masked = append(masked, '\n')
+					lineNumber++
+				case j < i+quoteLength || j >= end-quoteLength:
+					masked = append(masked, source[j])
+				default:
+					masked = append(masked, ' ')
+				}
+			}
+			i = end
+
+		case character == '\\' && i+1 < len(source) && (source[i+1] == '\n' || source[i+1] == '\r'):
+
+			// explicit line continuation
+			masked = append(masked, ' ')
+			i++
+
+			for i < len(source) && source[i] != '\n' {
+				masked = append(masked, ' ')
+				i++
+			}
+
+			if i < len(source) {
+				masked = append(masked, '\n')
+				lineNumber++
+				i++
+			}
+
+		case character == '\n':
+
+			lineNumber++
+			i++
+
+			if depth > 0 {
+				masked = append(masked, '\n')
+				continue
+			}
+			flush()
+
+		default:
+
+			switch character {
+			case '(', '[', '{':
+				depth++
+			case ')', ']', '}':
+				if depth > 0 {
+					depth--
+				}
+			}
+
+			masked = append(masked, character)
+			i++
+		}
+	}
+
+	flush()
+	return ret
+}
+
+/*
+	Given the index of the opening quote of a string literal in [source], returns the index just past its end, and the length of its quotes.
+	Unterminated (single-quoted) strings end at the end of their line.
+*/
+func skipString(source string, start int) (int, int) {
+
+	var quote string
+	var i int
+
+	quote = source[start : start+1]
+
+	if strings.HasPrefix(source[start:], strings.Repeat(quote, 3)) {
+
+		quote = strings.Repeat(quote, 3)
+
+		for i = start + 3; i < len(source); i++ {
+
+			if source[i] == '\\' {
+				i++
+				continue
+			}
+
+			if strings.HasPrefix(source[i:], quote) {
+				return i + 3, 3
+			}
+		}
+		return len(source), 3
+	}
+
+	for i = start + 1; i < len(source); i++ {
+
+		switch source[i] {
+		case '\\':
+			i++
+		case quote[0]:
+			return i + 1, 1
+		case '\n':
+			return i, 1
+		}
+	}
+	return len(source), 1
+}
+
+/*
+	Finds the names bound by the given logical [line], which is known to be at module scope.
+	Also returns whether the line begins an indented block, and if so, whether that block is a function or class body.
+*/
+func analyzeStatement(line logicalLine) ([]SymbolDefinition, bool, bool) {
+
+	var ret []SymbolDefinition
+	var keyword, body string
+	var colon, headerStart int
+	var isScope bool
+
+	headerStart = line.indent
+	keyword = identifierRegex.FindString(line.text[headerStart:])
+
+	// 'async def', 'async for' and 'async with' bind names the same way as their synchronous forms.
+	if keyword == "async" {
+
+		next := strings.TrimLeft(line.text[headerStart+len(keyword):], " \t")
+		headerStart = len(line.text) - len(next)
+		keyword = identifierRegex.FindString(next)
+	}
+
+	colon = findHeaderColon(line.text, headerStart)
+	if !isCompoundStatement(keyword, line.text, headerStart, colon) {
+
+		for _, statement := range splitStatements(line.text, headerStart, len(line.text)) {
+			ret = append(ret, simpleStatementBindings(line, statement[0], statement[1])...)
+		}
+		return ret, false, false
+	}
+
+	switch keyword {
+	case "def", "class":
+
+		isScope = true
+		ret = append(ret, definitionBindings(line, headerStart, colon)...)
+
+	case "for":
+
+		// the targets are everything between 'for' and the first 'in' keyword.
+		end := findKeyword(line.text, headerStart+len(keyword), colon, "in")
+		if end >= 0 {
+			ret = append(ret, targetBindings(line, headerStart+len(keyword), end, false)...)
+		}
+
+	case "with":
+		ret = append(ret, asBindings(line, headerStart, colon)...)
+
+	case "except":
+
+		ret = append(ret, asBindings(line, headerStart, colon)...)
+
+		// python 2's 'except Error, name:'
+		if findKeyword(line.text, headerStart, colon, "as") < 0 {
+			if comma := findDepthZero(line.text, headerStart, colon, ","); comma >= 0 {
+				ret = append(ret, targetBindings(line, comma+1, colon, false)...)
+			}
+		}
+
+	case "case":
+
+		// the pattern ends at its guard, if it has one.
+		end := findKeyword(line.text, headerStart+len(keyword), colon, "if")
+		if end < 0 {
+			end = colon
+		}
+		ret = append(ret, targetBindings(line, headerStart+len(keyword), end, true)...)
+	}
+
+	if !isScope {
+		ret = append(ret, walrusBindings(line, headerStart, colon)...)
+	}
+
+	// a body on the same line as its header ('if x: y = 1') is part of the same scope as the header, unless it's a definition.
+	body = strings.TrimSpace(line.text[colon+1:])
+	if body == "" {
+		return ret, true, isScope
+	}
+
+	if !isScope {
+		for _, statement := range splitStatements(line.text, colon+1, len(line.text)) {
+			ret = append(ret, simpleStatementBindings(line, statement[0], statement[1])...)
+		}
+	}
+	return ret, false, false
+}
+
+/*
+	Returns true if the statement beginning with [keyword] at [start] is a compound statement, whose header ends at [colon].
+	'match' and 'case' are only keywords in compound statements; otherwise they're ordinary names.
+*/
+func isCompoundStatement(keyword string, text string, start int, colon int) bool {
+
+	var equals int
+
+	switch keyword {
+	case "if", "elif", "else", "while", "for", "try", "except", "finally", "with", "def", "class":
+		return colon >= 0
+
+	case "match", "case":
+
+		if colon < 0 {
+			return false
+		}
+
+		// 'match = 1', 'case: int = 1' and 'case[0] = 1' are simple statements.
+		equals = findAssignment(text, start, len(text))
+		next := strings.TrimLeft(text[start+len(keyword):], " \t")
+		return !strings.HasPrefix(next, ":") && !strings.HasPrefix(next, ".") && (equals < 0 || equals > colon)
+	}
+	return false
+}
+
+/*
+	Finds the names bound by a single simple statement within [line], between [start] and [end].
+*/
+func simpleStatementBindings(line logicalLine, start int, end int) []SymbolDefinition {
+
+	var ret []SymbolDefinition
+	var statement, keyword string
+	var equals, annotation, partStart int
+
+	statement = line.text[start:end]
+	keyword = identifierRegex.FindString(strings.TrimLeft(statement, " \t\n"))
+
+	ret = walrusBindings(line, start, end)
+
+	switch keyword {
+	case "import", "from", "global", "nonlocal":
+		return ret
+
+	case "del":
+		index := strings.Index(statement, keyword)
+		return append(ret, targetBindings(line, start+index+len(keyword), end, false)...)
+
+	case "type":
+
+		// a type alias binds only its name, never 'type' itself.
+		index := strings.Index(statement, keyword)
+		match := typeAliasRegex.FindStringSubmatchIndex(statement[index:])
+		if len(match) > 0 && findAssignment(line.text, start, end) >= 0 {
+			return append(ret, line.symbolAt(start+index+match[2], start+index+match[3]))
+		}
+	}
+
+	equals = findAssignment(line.text, start, end)
+	annotation = findDepthZero(line.text, start, end, ":")
+
+	// annotated assignments ('x: int = 1', or just 'x: int') bind their target, if it's a plain name.
+	// a parenthesized target ('(x): int = 1') is only bound when it's given a value.
+	if annotation >= 0 && (equals < 0 || annotation < equals) && !strings.Contains(line.text[start:annotation], "lambda") {
+
+		target := strings.TrimSpace(line.text[start:annotation])
+		if strings.HasPrefix(target, "(") && equals < 0 {
+			return ret
+		}
+
+		if identifierRegex.MatchString(strings.Trim(target, "( \t\n")) {
+			ret = append(ret, targetBindings(line, start, annotation, false)...)
+		}
+		return ret
+	}
+
+	if equals < 0 {
+		return ret
+	}
+
+	// augmented assignment ('x += 1')
+	if equals > start && strings.ContainsRune("+-*/%@&|^<>", rune(line.text[equals-1])) {
+		return append(ret, targetBindings(line, start, equals-1, false)...)
+	}
+
+	// every part but the last of a chained assignment ('a = b = 1') is a target. Anything containing a lambda is the value.
+	partStart = start
+	for equals >= 0 {
+
+		if strings.Contains(line.text[partStart:equals], "lambda") {
+			break
+		}
+
+		ret = append(ret, targetBindings(line, partStart, equals, false)...)
+
+		partStart = equals + 1
+		equals = findAssignment(line.text, partStart, end)
+	}
+	return ret
+}
+
+/*
+	Finds the name of the function or class defined by the header between [start] and [colon].
+	The header is a whole logical line, so signatures spread over several lines, return annotations and type parameters are all part of it.
+	Any 'async' has already been skipped, and decorators are logical lines of their own which bind nothing.
+*/
+func definitionBindings(line logicalLine, start int, colon int) []SymbolDefinition {
+
+	var ret SymbolDefinition
+	var match []int
+
+	match = definitionRegex.FindStringSubmatchIndex(line.text[start : colon+1])
+	if len(match) == 0 {
+		return nil
+	}
+
+	ret = line.symbolAt(start+match[2], start+match[3])
+	ret.Definition = true
+	return []SymbolDefinition{ret}
+}
+
+/*
+	Finds the targets of every 'as' clause between [start] and [end]; 'with a as b, c as (d, e)'.
+*/
+func asBindings(line logicalLine, start int, end int) []SymbolDefinition {
+
+	var ret []SymbolDefinition
+	var as, targetEnd int
+
+	as = findKeyword(line.text, start, end, "as")
+
+	for as >= 0 {
+
+		targetEnd = findTargetEnd(line.text, as+2, end)
+		ret = append(ret, targetBindings(line, as+2, targetEnd, false)...)
+
+		as = findKeyword(line.text, targetEnd, end, "as")
+	}
+	return ret
+}
+
+/*
+	Finds the names bound by an assignment target (or, if [isPattern], a match pattern) between [start] and [end].
+	Names within tuples and lists are bound, but attributes, subscripts and anything else within them aren't.
+	In a pattern, any plain name (other than '_') is a capture, regardless of depth.
+*/
+func targetBindings(line logicalLine, start int, end int, isPattern bool) []SymbolDefinition {
+
+	var ret []SymbolDefinition
+	var containers []bool
+	var name, before, after string
+	var bound bool
+
+	for i := start; i < end; {
+
+		character := line.text[i]
+
+		if isIdentifierStart(character) && (i == 0 || !isIdentifierCharacter(line.text[i-1])) {
+
+			name = identifierRegex.FindString(line.text[i:end])
+			before = strings.TrimRight(line.text[start:i], " \t\n")
+			after = strings.TrimLeft(line.text[i+len(name):end], " \t\n")
+
+			bound = !pythonKeywords[name] && !strings.HasSuffix(before, ".") &&
+				!strings.HasPrefix(after, ".") && !strings.HasPrefix(after, "(") && !strings.HasPrefix(after, "[")
+
+			if isPattern {
+				// keyword names in class patterns ('Point(x=px)') aren't captures, nor is the wildcard.
+				bound = bound && name != "_" && !(strings.HasPrefix(after, "=") && !strings.HasPrefix(after, "=="))
+			} else {
+				for _, container := range containers {
+					bound = bound && container
+				}
+			}
+
+			if bound {
+				ret = append(ret, line.symbolAt(i, i+len(name)))
+			}
+
+			i += len(name)
+			continue
+		}
+
+		switch character {
+		case '(', '[', '{':
+
+			// brackets directly after a name (or another bracket) are a call or subscript, not a tuple or list.
+			before = strings.TrimRight(line.text[start:i], " \t\n")
+			containers = append(containers, character != '{' && !(len(before) > 0 && (isIdentifierCharacter(before[len(before)-1]) || strings.ContainsRune(")]}", rune(before[len(before)-1])))))
+
+		case ')', ']', '}':
+			if len(containers) > 0 {
+				containers = containers[:len(containers)-1]
+			}
+		}
+		i++
+	}
+	return ret
+}
+
+/*
+	Finds every name bound by an assignment expression ('name := value') between [start] and [end].
+*/
+func walrusBindings(line logicalLine, start int, end int) []SymbolDefinition {
+
+	var ret []SymbolDefinition
+
+	for _, match := range walrusRegex.FindAllStringSubmatchIndex(line.text[start:end], -1) {
+		ret = append(ret, line.symbolAt(start+match[2], start+match[3]))
+	}
+	return ret
+}
+
+/*
+	Returns the index of the colon which ends the header of a compound statement beginning at [start], or -1 if there isn't one.
+*/
+func findHeaderColon(text string, start int) int {
+
+	var depth int
+
+	for i := start; i < len(text); i++ {
+
+		switch text[i] {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case ':':
+			if depth == 0 && !(i+1 < len(text) && text[i+1] == '=') {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+/*
+	Returns the index of the first '=' between [start] and [end] (outside of brackets) which is an assignment,
+	rather than part of a comparison or assignment expression. Augmented assignments ('+=') are included. Returns -1 if there isn't one.
+*/
+func findAssignment(text string, start int, end int) int {
+
+	var depth int
+
+	for i := start; i < end; i++ {
+
+		switch text[i] {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case '=':
+
+			if depth != 0 {
+				continue
+			}
+
+			// '==', or the second half of '=='
+			if (i+1 < end && text[i+1] == '=') || (i > start && text[i-1] == '=') {
+				continue
+			}
+
+			// '!=', ':=', and '<=' or '>=' (but not '<<=' or '>>=')
+			if i > start && strings.ContainsRune("!:", rune(text[i-1])) {
+				continue
+			}
+			if i > start && strings.ContainsRune("<>", rune(text[i-1])) && !(i > start+1 && text[i-2] == text[i-1]) {
+				continue
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+	Returns the index of the first occurrence of [token] between [start] and [end], outside of brackets, or -1.
+*/
+func findDepthZero(text string, start int, end int, token string) int {
+
+	var depth int
+
+	for i := start; i < end; i++ {
+
+		switch text[i] {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		default:
+			if depth == 0 && strings.HasPrefix(text[i:end], token) && !(token == ":" && i+1 < end && text[i+1] == '=') {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+/*
+	Returns the index of the first occurrence of the given [keyword] (as a whole word) between [start] and [end], at any depth, or -1.
+*/
+func findKeyword(text string, start int, end int, keyword string) int {
+
+	for i := start; i+len(keyword) <= end; i++ {
+
+		if !strings.HasPrefix(text[i:], keyword) {
+			continue
+		}
+
+		if i > 0 && isIdentifierCharacter(text[i-1]) {
+			continue
+		}
+		if i+len(keyword) < len(text) && isIdentifierCharacter(text[i+len(keyword)]) {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+/*
+	Returns the end of a target which begins at [start]; the first comma or closing bracket at its own depth, or [end].
+*/
+func findTargetEnd(text string, start int, end int) int {
+
+	var depth int
+
+	for i := start; i < end; i++ {
+
+		switch text[i] {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return end
+}
+
+/*
+	Splits the text between [start] and [end] into simple statements, separated by semicolons outside of brackets.
+	Returns the start and end of each.
+*/
+func splitStatements(text string, start int, end int) [][2]int {
+
+	var ret [][2]int
+	var semicolon int
+
+	for {
+
+		semicolon = findDepthZero(text, start, end, ";")
+		if semicolon < 0 {
+			return append(ret, [2]int{start, end})
+		}
+
+		ret = append(ret, [2]int{start, semicolon})
+		start = semicolon + 1
+	}
+}
+
+/*
+	Returns the symbol found between the given [start] and [end] of this line's text, along with its physical line and column.
+*/
+func (this logicalLine) symbolAt(start int, end int) SymbolDefinition {
+
+	var line, lineStart int
+
+	line = this.line + strings.Count(this.text[:start], "\n")
+	lineStart = strings.LastIndex(this.text[:start], "\n") + 1
+
+	return SymbolDefinition{Name: this.text[start:end], Line: line, Column: start - lineStart + 1}
+}
+
+func isIdentifierStart(character byte) bool {
+	return character == '_' || (character >= 'a' && character <= 'z') || (character >= 'A' && character <= 'Z')
+}
+
+func isIdentifierCharacter(character byte) bool {
+	return isIdentifierStart(character) || (character >= '0' && character <= '9')
+}
@@ -0,0 +1,72 @@
+package coiler
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindBindings(test *testing.T) {
+
+	var cases = []struct {
+		name     string
+		source   string
+		expected []string
+	}{
+		{"assignment", "a = 1\nb: int = 2\nc: str\nd += 1", []string{"a", "b", "c", "d"}},
+		{"comparison", "if a == b:\n    pass\nwhile x != y: pass\nz = a <= b", []string{"z"}},
+		{"chained", "a = b = c.d = e[0] = 1", []string{"a", "b"}},
+		{"unpacking", "a, (b, [c, *d]) = value\n[e, f] = g", []string{"a", "b", "c", "d", "e", "f"}},
+		{"attributes and subscripts", "a.b = 1\nc[0] = 2\nd(e).f = 3", nil},
+		{"lambda", "f = lambda x=1: x\ng(key=lambda y: y)", []string{"f"}},
+		{"walrus", "if (n := len(a)) > 1:\n    pass\nprint(m := 2)", []string{"n", "m"}},
+		{"loops and context managers", "for i, j in pairs:\n    k = i\nwith open(p) as f, lock as (g, h):\n    pass", []string{"i", "j", "k", "f", "g", "h"}},
+		{"exceptions", "try:\n    import os\nexcept ImportError as error:\n    os = None\nexcept (KeyError, ValueError), old:\n    pass", []string{"error", "os", "old"}},
+		{"imports and declarations", "import a\nfrom b import c\nglobal d\ndel e", []string{"e"}},
+		{"definitions", "@decorator(\n    x=1)\nasync def f(\n    a,\n    b):\n    inner = 1\nclass C[T](Base):\n    attribute = 1\ndef g[T](x: T) -> T: return x", []string{"f", "C", "g"}},
+		{"strings", "s = \"a = 1\"\nt = '''\nb = 2\n'''  # c = 3", []string{"s", "t"}},
+		{"semicolons", "a = 1; b = 2\nif x: c = 3; d = 4", []string{"a", "b", "c", "d"}},
+		{"match", "match command:\n    case [\"go\", direction] if direction:\n        pass\n    case Point(x=px, y=_):\n        pass\nmatch = 1\ncase: int = 2", []string{"direction", "px", "match", "case"}},
+		{"type alias", "type Number = int\ntype Pair[T] = tuple[T, T]\nkind = type(value)\ntype = 3", []string{"Number", "Pair", "kind", "type"}},
+	}
+
+	for _, testCase := range cases {
+
+		var names []string
+
+		for _, binding := range findBindings(testCase.source) {
+			names = append(names, binding.Name)
+		}
+
+		if !reflect.DeepEqual(names, testCase.expected) {
+			test.Errorf("%s: expected %v, got %v", testCase.name, testCase.expected, names)
+		}
+	}
+}
+
+func TestFindBindingsLocations(test *testing.T) {
+
+	var bindings []SymbolDefinition
+	var expected []SymbolDefinition
+
+	bindings = findBindings(strings.Join([]string{
+		"x = 1",
+		"@decorator",
+		"def f(",
+		"        a):",
+		"    return a",
+		"if x:",
+		"    def f(): pass",
+		"type Alias = int",
+	}, "\n"))
+
+	expected = []SymbolDefinition{
+		{Name: "x", Line: 1, Column: 1},
+		{Name: "f", Line: 3, Column: 5, Definition: true, Ends: []int{5, 7}},
+		{Name: "Alias", Line: 8, Column: 6},
+	}
+
+	if !reflect.DeepEqual(bindings, expected) {
+		test.Errorf("expected %+v, got %+v", expected, bindings)
+	}
+}
@@ -1,18 +1,80 @@
 package coiler
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 )
 
 const (
 	NAMESPACE_SEPARATOR = "_ZC_"
 )
 
+const (
+	// the kinds of lookup entry which can provide a module, in the order python prefers them within a single directory.
+	LOOKUP_PACKAGE = iota
+	LOOKUP_EXTENSION
+	LOOKUP_SOURCE
+)
+
+var moduleNameRegex *regexp.Regexp
+var extensionModuleRegex *regexp.Regexp
+
+func init() {
+	moduleNameRegex = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+	extensionModuleRegex = regexp.MustCompile("^([a-zA-Z_][a-zA-Z0-9_]*)(?:\\.[^.]+)?\\.(?:so|pyd)$")
+}
+
+/*
+	Options which control how modules are found and combined for a build.
+*/
+type BuildOptions struct {
+
+	// If true, system libraries are combined as well as user and third-party modules.
+	UseSystemPaths bool
+
+	// The python interpreter used to discover search paths and compile output. Defaults to "python".
+	Interpreter string
+
+	// Additional directories to search for modules, ahead of the interpreter's own search paths.
+	SearchPaths []string
+
+	// A directory of wheels, and the requirements (or lock) file which picks from them (see UnpackWheelhouse).
+	// The session unpacks the wheels picked, and searches their directories after SearchPaths.
+	Wheelhouse       string
+	RequirementsPath string
+
+	// If given, the virtualenv whose site-packages are searched for third-party modules. Its base interpreter should be the Interpreter.
+	VirtualEnv *VirtualEnv
+
+	// Module name patterns (as used by filepath.Match). If any include patterns are given, only matching modules are combined.
+	// Modules matching an exclude pattern are never combined. Modules which aren't combined are imported normally at runtime.
+	Include []string
+	Exclude []string
+
+	// Files to embed in the combined output, available at runtime through the '__coiler_data__' dictionary.
+	// Keys are the names each file is embedded under, values are the paths to read them from.
+	DataFiles map[string]string
+
+	// Where the analysis of each source file is cached between runs. If empty, nothing is cached on disk.
+	CacheDirectory string
+
+	// How symbols are renamed when combined. One of MANGLE_SEPARATOR (the default), MANGLE_HASH, or MANGLE_INDEX.
+	Mangling string
+
+	// If true, combined functions and classes get back their original __name__, __qualname__ and __module__ at runtime,
+	// and combined modules are registered under their original names, so that pickles made without coiler still load.
+	PreserveNames bool
+}
+
 /*
 	A BuildContext is used to maintain knowledge about the current state of a build.
 */
@@ -24,61 +86,156 @@ type BuildContext struct {
 	// A list of non-combined import modules which need to be included in the final combined output
 	externalDependencies []string
 
+	// combined modules which are imported dynamically (by name), and so need to be registered in sys.modules at runtime.
+	dynamicModules []string
+
 	// Contains a mapping of fully-qualified function names and variable names
-	// and the translated version of each.
+	// and the translated version of each. Filled once every file has been parsed.
 	symbols map[string]string
 
+	// every top-level symbol defined by a combined file, in no particular order.
+	definitions []symbolDefinition
+
+	// every warning and error found while parsing, in no particular order.
+	diagnostics []Diagnostic
+
 	// represents every file that has been functionally included (if not necessarily combined into)
 	// the output file for this build run.
 	importedFiles []string
 
-	// the paths used for external module lookups.
-	// different modes of operation mutate this.
-	// keys are module names, values are absolute paths to the source files for them
-	lookupFiles map[string]string
+	// the session this build is part of, which provides module lookups and cached parses.
+	session *BuildSession
+
+	// the absolute path to the entry point of this build.
+	entryPoint string
+
+	options BuildOptions
+
+	// guards symbols, definitions, diagnostics, importedFiles and dependencies, since files are parsed by several workers at once.
+	lock sync.Mutex
 }
 
-func NewBuildContext(useSystemPaths bool) *BuildContext {
+func NewBuildContext(session *BuildSession) *BuildContext {
 
 	var ret *BuildContext
 
 	ret = new(BuildContext)
+	ret.session = session
+	ret.options = session.options
 	ret.symbols = make(map[string]string)
 	ret.dependencies = NewDependencyGraph()
-	ret.lookupFiles = determineLookupFiles(determineLookupPaths(useSystemPaths))
 
 	return ret
 }
 
 /*
-	Takes a fully-qualified symbol name, and creates a namespaced version suitable for use in combined files.
-	Returns the translated name.
+	Records a fully-qualified symbol name, defined by the given [file] at the given [line] and [column].
+	The name is translated into a version suitable for use in combined files once every file has been parsed.
 */
-func (this *BuildContext) AddSymbol(symbol string) string {
+func (this *BuildContext) AddSymbol(symbol string, file *FileContext, line int, column int) {
 
-	var translatedSymbol string
+	this.lock.Lock()
+	defer this.lock.Unlock()
 
-	translatedSymbol = strings.Replace(symbol, ".", NAMESPACE_SEPARATOR, -1)
-	this.symbols[symbol] = translatedSymbol
-	return translatedSymbol
+	this.definitions = append(this.definitions, symbolDefinition{qualifiedName: symbol, file: file, line: line, column: column})
 }
 
 func (this *BuildContext) TranslateSymbol(symbol string) string {
 
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
 	return this.symbols[symbol]
 }
 
+func (this *BuildContext) AddDiagnostic(diagnostic Diagnostic) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.diagnostics = append(this.diagnostics, diagnostic)
+}
+
+/*
+	Returns every diagnostic found while parsing, ordered by location.
+*/
+func (this *BuildContext) GetDiagnostics() []Diagnostic {
+
+	var ret []Diagnostic
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	ret = append(ret, this.diagnostics...)
+	sortDiagnostics(ret)
+	return ret
+}
+
+/*
+	Returns the full path of every file linked into this build so far, in the order they were linked.
+*/
+func (this *BuildContext) getLinkedPaths() []string {
+
+	var ret []string
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, node := range this.dependencies.nodes {
+		ret = append(ret, node.fileContext.fullPath)
+	}
+	return ret
+}
+
+func (this *BuildContext) HasErrors() bool {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, diagnostic := range this.diagnostics {
+		if diagnostic.Severity == SEVERITY_ERROR {
+			return true
+		}
+	}
+	return false
+}
+
 func (this *BuildContext) AddImportedFile(module string) {
 
-	if !this.IsFileImported(module) {
-		this.importedFiles = append(this.importedFiles, module)
+	this.ClaimImportedFile(module)
+}
+
+/*
+	Marks the given [module] as imported, returning true if it wasn't already.
+	Only the caller which successfully claims a module should parse it.
+*/
+func (this *BuildContext) ClaimImportedFile(module string) bool {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.isFileImported(module) {
+		return false
 	}
+
+	this.importedFiles = append(this.importedFiles, module)
+	return true
 }
 
+/*
+	Returns the combined file which provides the given [module], or nil if it isn't combined.
+*/
 func (this *BuildContext) GetFileContext(module string) *FileContext {
 
+	var path string
+
+	path = this.FindSourcePath(module)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
 	for _, node := range this.dependencies.nodes {
-		if node.fileContext.namespace == module {
+		if node.fileContext.fullPath == path {
 			return node.fileContext
 		}
 	}
@@ -87,6 +244,14 @@ func (this *BuildContext) GetFileContext(module string) *FileContext {
 
 func (this *BuildContext) IsFileImported(module string) bool {
 
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.isFileImported(module)
+}
+
+func (this *BuildContext) isFileImported(module string) bool {
+
 	for _, file := range this.importedFiles {
 		if module == file {
 			return true
@@ -100,10 +265,113 @@ func (this *BuildContext) IsFileImported(module string) bool {
 */
 func (this *BuildContext) FindSourcePath(module string) string {
 
-	return this.lookupFiles[module]
+	var providers []string
+
+	if !this.options.ShouldCombine(module) {
+		return ""
+	}
+
+	// whatever comes first is what python would import, even if it's not a source file which can be combined.
+	providers = this.session.lookupFiles[module]
+	if len(providers) == 0 || filepath.Ext(providers[0]) != ".py" {
+		return ""
+	}
+	return providers[0]
+}
+
+/*
+	Warns if the combined module imported by the given [statement] (of the [importer]) shadows anything else;
+	whatever provides the same module in later lookup directories, or a standard library module of the same name.
+*/
+func (this *BuildContext) reportShadowing(statement ImportStatement, importer *FileContext) {
+
+	var providers []string
+	var message string
+
+	providers = this.session.lookupFiles[statement.Module]
+	if len(providers) == 0 {
+		return
+	}
+
+	if len(providers) > 1 {
+
+		message = fmt.Sprintf("'%s' is found in more than one lookup directory. '%s' is combined, which shadows '%s'", statement.Module, providers[0], strings.Join(providers[1:], "', '"))
+		this.AddDiagnostic(newDiagnostic(SEVERITY_WARNING, DIAGNOSTIC_SHADOWED_MODULE, importer.fullPath, statement.Line, statement.Column, message))
+	}
+
+	if this.session.stdlibModules[statement.Module] && !this.session.isStandardLibrary(providers[0]) {
+
+		message = fmt.Sprintf("'%s' shadows the standard library module '%s'. Anything else which imports '%s' at runtime gets the standard library module instead", providers[0], statement.Module, statement.Module)
+		this.AddDiagnostic(newDiagnostic(SEVERITY_WARNING, DIAGNOSTIC_SHADOWED_STDLIB, importer.fullPath, statement.Line, statement.Column, message))
+	}
+}
+
+/*
+	Adds an error if the module imported by the given [statement] (of the [importer]) is a package provided by an unpacked wheel.
+	Only the top-level modules of a wheel can be combined, and since the wheel isn't installed anywhere, its packages can't be imported at runtime.
+	Returns true if an error was added.
+*/
+func (this *BuildContext) reportWheelPackage(statement ImportStatement, importer *FileContext) bool {
+
+	var providers []string
+	var module, packagePath, message string
+
+	if statement.Module == "" {
+		return false
+	}
+
+	module = strings.SplitN(statement.Module, ".", 2)[0]
+	providers = this.session.lookupFiles[module]
+
+	for _, wheel := range this.session.wheels {
+
+		packagePath, _ = filepath.Abs(filepath.Join(wheel.Path, module))
+		if !isDirectory(packagePath) {
+			continue
+		}
+
+		// whatever comes first is what python imports. Namespace packages aren't lookup entries, so they never come first.
+		if len(providers) > 0 && providers[0] != packagePath {
+			return false
+		}
+
+		message = fmt.Sprintf("'%s' is a package from '%s', picked by '%s' (%s). Packages can't be combined, and the wheel isn't available at runtime. "+
+			"Install it where the output runs and leave it out of the requirements instead", module, wheel.Name, wheel.Requirement, wheel.Location)
+		this.AddDiagnostic(newDiagnostic(SEVERITY_ERROR, DIAGNOSTIC_WHEEL_PACKAGE, importer.fullPath, statement.Line, statement.Column, message))
+		return true
+	}
+	return false
+}
+
+/*
+	Returns true if the given [module] may be combined, according to these options' include and exclude patterns.
+*/
+func (this BuildOptions) ShouldCombine(module string) bool {
+
+	var included bool
+
+	included = len(this.Include) == 0
+
+	for _, pattern := range this.Include {
+		if matched, _ := filepath.Match(pattern, module); matched {
+			included = true
+			break
+		}
+	}
+
+	for _, pattern := range this.Exclude {
+		if matched, _ := filepath.Match(pattern, module); matched {
+			return false
+		}
+	}
+	return included
 }
 
 func (this *BuildContext) AddDependency(context *FileContext) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
 	this.dependencies.AddNode(context)
 }
 
@@ -118,91 +386,362 @@ func (this *BuildContext) AddExternalDependency(module string) {
 	this.externalDependencies = append(this.externalDependencies, module)
 }
 
+func (this *BuildContext) AddDynamicModule(module string) {
+
+	if !this.IsDynamicModule(module) {
+		this.dynamicModules = append(this.dynamicModules, module)
+	}
+}
+
+func (this *BuildContext) IsDynamicModule(module string) bool {
+
+	for _, dynamicModule := range this.dynamicModules {
+		if dynamicModule == module {
+			return true
+		}
+	}
+	return false
+}
+
 func (this *BuildContext) GetCombinedFileCount() int {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
 	return len(this.dependencies.nodes)
 }
 
 /*
-	Determines the python lookup paths to use.
+	Returns every combined file, ordered so that each file comes after the files it depends upon.
 */
-func determineLookupPaths(useSystemPaths bool) []string {
+func (this *BuildContext) GetCombinedFiles() []*FileContext {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.dependencies.DiscoverNeighbors()
+	return this.dependencies.GetOrderedNodes()
+}
+
+func (this *BuildContext) GetExternalDependencies() []string {
+	return this.externalDependencies
+}
+
+/*
+	Describes where the interpreter finds modules, as reported by LOOKUP_SCRIPT.
+*/
+type interpreterPaths struct {
+
+	// sys.path, in order.
+	Path []string `json:"path"`
+
+	// the names of every standard library module, and the directories they're found in.
+	Stdlib            []string `json:"stdlib"`
+	StdlibDirectories []string `json:"stdlibDirectories"`
+}
+
+const (
+	// reports the interpreter's search path and standard library modules. Before python 3.10 (which lists them),
+	// the standard library modules are those of its standard library directories, and those built into the interpreter.
+	// anything else is left off the search path while this runs, since the project may well shadow the modules it uses.
+	// base prefixes only exist from python 3.3 (where virtual environments began), before then there's only the prefix.
+	// python 2's list comprehensions leak their variable into the script, so each uses a name nothing else in it does.
+	LOOKUP_SCRIPT = `
+import sys
+path = list(sys.path)
+prefixes = (sys.prefix, getattr(sys, 'base_prefix', sys.prefix), sys.exec_prefix, getattr(sys, 'base_exec_prefix', sys.exec_prefix))
+sys.path = [entry for entry in path if entry.startswith(prefixes) and entry]
+import json, pkgutil, sysconfig
+paths = sysconfig.get_paths()
+directories = [paths['stdlib'], paths['platstdlib']] + [candidate for candidate in sys.path if candidate.endswith('lib-dynload')]
+names = getattr(sys, 'stdlib_module_names', None)
+if names is None:
+	names = set(sys.builtin_module_names) | set(module[1] for module in pkgutil.iter_modules(directories))
+print(json.dumps({'path': path, 'stdlib': sorted(names), 'stdlibDirectories': directories}))
+`
+)
+
+/*
+	Determines the python lookup paths to use, in order of precedence, as well as what the interpreter reports about its standard library.
+	Returns an error if the interpreter can't be run, or doesn't report its paths.
+*/
+func determineLookupPaths(interpreter string, useSystemPaths bool) ([]string, interpreterPaths, error) {
 
 	var process *exec.Cmd
-	var pathExtractor *regexp.Regexp
+	var reported interpreterPaths
+	var exitError *exec.ExitError
 	var output []byte
 	var paths []string
-	var matches [][]string
-	var userPath string
-	var pyPaths string
-	var path string
-
-	userPath = os.Getenv("PYTHONPATH")
+	var userPaths []string
+	var err error
 
-	process = exec.Command("python", "-c", "import sys; print(sys.path)")
-	output, _ = process.Output()
-	pyPaths = string(output)
+	userPaths = filepath.SplitList(os.Getenv("PYTHONPATH"))
 
-	pathExtractor = regexp.MustCompile("'([^']*)'")
-	matches = pathExtractor.FindAllStringSubmatch(pyPaths, -1)
+	process = exec.Command(interpreter, "-c", LOOKUP_SCRIPT)
+	output, err = process.Output()
+	if err != nil {
 
-	for _, match := range matches {
+		errorMsg := fmt.Sprintf("Unable to read the search paths of '%s': %v", interpreter, err)
+		if errors.As(err, &exitError) && len(exitError.Stderr) > 0 {
+			errorMsg = fmt.Sprintf("Unable to read the search paths of '%s':\n%s", interpreter, strings.TrimSpace(string(exitError.Stderr)))
+		}
+		return nil, reported, errors.New(errorMsg)
+	}
 
-		path = match[1]
+	err = json.Unmarshal(output, &reported)
+	if err != nil {
 
-		// ignore egg files for right now
-		if strings.HasSuffix(path, ".egg") {
-			continue
+		printed := strings.TrimSpace(string(output))
+		if len(printed) > 200 {
+			printed = printed[:200] + "..."
 		}
 
+		errorMsg := fmt.Sprintf("Unable to read the search paths of '%s', it printed '%s': %v", interpreter, printed, err)
+		return nil, reported, errors.New(errorMsg)
+	}
+
+	for _, path := range reported.Path {
+
 		// if we do not use system paths, trim out any paths that are not descended from PYTHONPATH or local.
-		if !useSystemPaths &&
-			(len(userPath) <= 0 || !strings.HasPrefix(path, userPath)) &&
-			path != "" &&
-			path != "." {
+		if !useSystemPaths && !isUserPath(path, userPaths) && path != "" && path != "." {
 			continue
 		}
 
 		paths = append(paths, path)
 	}
-
-	return paths
+	return paths, reported, nil
 }
 
 /*
-	Given a list of directories, finds all python source files. Does not recurse.
-	Returns a map of module names to absolute paths.
+	Adds the directories named by '.pth' files in any site directory (such as 'site-packages') among the given lookup [paths],
+	just after the site directory itself, as python's site module would. Lines which python would run as code are ignored,
+	as are directories which don't exist. Paths which have already been given are left out.
 */
-func determineLookupFiles(paths []string) map[string]string {
+func expandPathFiles(paths []string) []string {
 
-	var ret map[string]string
-	var sourceFiles []string
-	var directoryName string
-	var fullPath, module string
+	var ret, pathFiles []string
+	var known map[string]bool
+	var contents []byte
+	var entry string
 	var err error
 
-	ret = make(map[string]string)
+	known = make(map[string]bool)
+
+	add := func(path string) bool {
+
+		if known[path] {
+			return false
+		}
+
+		known[path] = true
+		ret = append(ret, path)
+		return true
+	}
 
 	for _, path := range paths {
 
-		directoryName = filepath.Join(path, "*.py")
-		sourceFiles, err = filepath.Glob(directoryName)
+		if !add(path) || !isSiteDirectory(path) {
+			continue
+		}
+
+		pathFiles, err = filepath.Glob(filepath.Join(path, "*.pth"))
 		if err != nil {
-			fmt.Printf("Unable to read source file list from python lookup path '%s', skipping\n", path)
 			continue
 		}
+		sort.Strings(pathFiles)
+
+		for _, pathFile := range pathFiles {
+
+			contents, err = ioutil.ReadFile(pathFile)
+			if err != nil {
+				continue
+			}
+
+			for _, line := range strings.Split(string(contents), "\n") {
+
+				line = strings.TrimSpace(line)
+				if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "import ") || strings.HasPrefix(line, "import\t") {
+					continue
+				}
+
+				entry = line
+				if !filepath.IsAbs(entry) {
+					entry = filepath.Join(path, entry)
+				}
+
+				if _, err = os.Stat(entry); err == nil {
+					add(entry)
+				}
+			}
+		}
+	}
+	return ret
+}
+
+/*
+	Returns true if the given [path] is a site directory, whose '.pth' files python follows.
+*/
+func isSiteDirectory(path string) bool {
+
+	var name string
+
+	name = filepath.Base(path)
+	return name == "site-packages" || name == "dist-packages"
+}
+
+/*
+	Returns true if the given [path] is (or is within) one of the given [userPaths], from PYTHONPATH.
+*/
+func isUserPath(path string, userPaths []string) bool {
+
+	for _, userPath := range userPaths {
+		if userPath != "" && strings.HasPrefix(path, userPath) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Given a list of lookup paths (in order of precedence), finds every module they provide. Does not recurse.
+	Lookup paths are usually directories, but may also be zip archives (such as eggs, wheels and zipapps), which are read directly.
+	Returns a map of module names to the absolute paths of whatever provides them, in order of precedence, one per lookup path.
+	Only python source files can be combined, but packages and extension modules are included too, since python prefers them
+	to a source file of the same name in the same directory, and to anything in a later directory.
+*/
+func determineLookupFiles(paths []string) map[string][]string {
+
+	var ret map[string][]string
+	var providers *lookupProviders
+	var directory string
+	var err error
+
+	ret = make(map[string][]string)
+
+	for _, path := range paths {
+
+		// the empty path is the current directory
+		directory = path
+		if directory == "" {
+			directory = "."
+		}
 
-		for _, sourceFile := range sourceFiles {
+		providers, err = findDirectoryModules(directory)
+		if err != nil {
 
-			fullPath, err = filepath.Abs(sourceFile)
+			providers, err = findArchiveModules(directory)
 			if err != nil {
 				continue
 			}
+		}
 
-			module = filepath.Base(sourceFile)
-			module = strings.TrimSuffix(module, filepath.Ext(module))
-			ret[module] = fullPath
+		for module, fullPath := range providers.paths {
+			ret[module] = append(ret[module], fullPath)
 		}
 	}
 
 	return ret
 }
+
+/*
+	Whatever provides each module within a single lookup path, keeping only what python would prefer.
+*/
+type lookupProviders struct {
+	paths map[string]string
+	ranks map[string]int
+}
+
+func newLookupProviders() *lookupProviders {
+
+	var ret *lookupProviders
+
+	ret = new(lookupProviders)
+	ret.paths = make(map[string]string)
+	ret.ranks = make(map[string]int)
+
+	return ret
+}
+
+/*
+	Records that the given [module] is provided by the given (absolute) [path], unless something of a lower [rank] already provides it.
+*/
+func (this *lookupProviders) add(module string, path string, rank int) {
+
+	existingRank, found := this.ranks[module]
+	if found && existingRank <= rank {
+		return
+	}
+
+	this.paths[module] = path
+	this.ranks[module] = rank
+}
+
+/*
+	Finds every module provided by the given [directory].
+*/
+func findDirectoryModules(directory string) (*lookupProviders, error) {
+
+	var ret *lookupProviders
+	var entries []os.FileInfo
+	var fullPath, module string
+	var rank int
+	var err error
+
+	entries, err = ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	ret = newLookupProviders()
+
+	for _, entry := range entries {
+
+		module, rank = classifyLookupEntry(directory, entry)
+		if module == "" {
+			continue
+		}
+
+		fullPath, err = filepath.Abs(filepath.Join(directory, entry.Name()))
+		if err != nil {
+			continue
+		}
+
+		ret.add(module, fullPath, rank)
+	}
+	return ret, nil
+}
+
+/*
+	Determines which module the given directory [entry] (within [directory]) provides, if any,
+	and its rank among things in the same directory which provide the same module (lowest first, as python looks for them).
+*/
+func classifyLookupEntry(directory string, entry os.FileInfo) (string, int) {
+
+	var matches []string
+	var name string
+
+	name = entry.Name()
+
+	if entry.IsDir() {
+
+		if !moduleNameRegex.MatchString(name) {
+			return "", 0
+		}
+
+		// directories without an '__init__.py' are namespace packages, which only apply if nothing else provides the module.
+		if _, err := os.Stat(filepath.Join(directory, name, "__init__.py")); err != nil {
+			return "", 0
+		}
+		return name, LOOKUP_PACKAGE
+	}
+
+	matches = extensionModuleRegex.FindStringSubmatch(name)
+	if len(matches) > 0 {
+		return matches[1], LOOKUP_EXTENSION
+	}
+
+	if filepath.Ext(name) == ".py" && moduleNameRegex.MatchString(strings.TrimSuffix(name, ".py")) {
+		return strings.TrimSuffix(name, ".py"), LOOKUP_SOURCE
+	}
+	return "", 0
+}
@@ -0,0 +1,116 @@
+package coiler
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+/*
+	Search paths (a project's search_paths) come before the interpreter's own,
+	so whatever they provide has to shadow a module of the same name in a later lookup path.
+*/
+func TestDetermineLookupFilesPrecedence(test *testing.T) {
+
+	var searchPath, interpreterPath string
+	var lookupFiles map[string][]string
+	var expected []string
+
+	root, err := ioutil.TempDir("", "coiler-lookup")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	searchPath = filepath.Join(root, "vendor")
+	interpreterPath = filepath.Join(root, "site-packages")
+
+	writeTestFiles(test, searchPath, "util.py", "only_vendor.py")
+	writeTestFiles(test, interpreterPath, "util.py", "only_site.py", "pkg/__init__.py", "pkg.py")
+
+	lookupFiles = determineLookupFiles([]string{searchPath, interpreterPath})
+
+	expected = []string{filepath.Join(searchPath, "util.py"), filepath.Join(interpreterPath, "util.py")}
+	if !reflect.DeepEqual(lookupFiles["util"], expected) {
+		test.Errorf("expected 'util' to be provided by %v, got %v", expected, lookupFiles["util"])
+	}
+
+	// a package shadows a source file of the same name in the same directory.
+	expected = []string{filepath.Join(interpreterPath, "pkg")}
+	if !reflect.DeepEqual(lookupFiles["pkg"], expected) {
+		test.Errorf("expected 'pkg' to be provided by %v, got %v", expected, lookupFiles["pkg"])
+	}
+
+	if len(lookupFiles["only_vendor"]) != 1 || len(lookupFiles["only_site"]) != 1 {
+		test.Errorf("expected modules found in only one lookup path to be provided once, got %v", lookupFiles)
+	}
+}
+
+/*
+	A build which fails still reports every file it reached, so that watch mode can rebuild once any of them is fixed.
+*/
+func TestDiagnosticErrorPaths(test *testing.T) {
+
+	var session *BuildSession
+	var diagnosticError *DiagnosticError
+	var expected []string
+
+	root, err := ioutil.TempDir("", "coiler-failed")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// 'x_ZC_y' in 'a' and 'y' in 'a_ZC_x' are both combined as 'a_ZC_x_ZC_y'.
+	err = ioutil.WriteFile(filepath.Join(root, "main.py"), []byte("import a\nimport a_ZC_x\n"), 0644)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(root, "a.py"), []byte("x_ZC_y = 1\n"), 0644)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(root, "a_ZC_x.py"), []byte("y = 2\n"), 0644)
+	}
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	session = &BuildSession{
+		lookupPaths: []string{root},
+		lookupFiles: determineLookupFiles([]string{root}),
+		cache:       NewParseCache(""),
+	}
+
+	_, err = session.Parse(filepath.Join(root, "main.py"))
+	if !errors.As(err, &diagnosticError) {
+		test.Fatalf("expected the build to fail with diagnostics, got %v", err)
+	}
+
+	expected = []string{filepath.Join(root, "main.py"), filepath.Join(root, "a.py"), filepath.Join(root, "a_ZC_x.py")}
+	if !reflect.DeepEqual(diagnosticError.Paths, expected) {
+		test.Errorf("expected the failed build to have reached %v, got %v", expected, diagnosticError.Paths)
+	}
+}
+
+/*
+	Creates each of the given (slash-separated) [names] as an empty file within [directory].
+*/
+func writeTestFiles(test *testing.T, directory string, names ...string) {
+
+	var path string
+
+	for _, name := range names {
+
+		path = filepath.Join(directory, filepath.FromSlash(name))
+
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte{}, 0644)
+		}
+
+		if err != nil {
+			test.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package coiler
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+/*
+	A BuildSession holds everything that can be shared between the builds of several entry points;
+	the module lookup table, and the cache of parsed source files.
+	Each entry point still gets its own BuildContext. Builds from the same session may run concurrently.
+*/
+type BuildSession struct {
+	options BuildOptions
+
+	// the directories searched for modules, in order
+	lookupPaths []string
+
+	// keys are module names, values are absolute paths to whatever provides them in each lookup directory, in order of precedence.
+	lookupFiles map[string][]string
+
+	// the names of every standard library module, and the (absolute) directories they're found in.
+	stdlibModules     map[string]bool
+	stdlibDirectories []string
+
+	cache *ParseCache
+
+	// the wheels picked from the options' wheelhouse, and (when there's no cache to unpack them into) the temporary directory they're in.
+	wheels             []UnpackedWheel
+	temporaryDirectory string
+}
+
+/*
+	Creates a session for builds with the given [options], unpacking any wheels they pick. The session must be closed once it's done with.
+	Returns an error if the interpreter can't report where it finds modules, or the wheels can't be unpacked.
+*/
+func NewBuildSession(options BuildOptions) (*BuildSession, error) {
+
+	var ret *BuildSession
+	var paths, interpreterLookupPaths []string
+	var reported interpreterPaths
+	var err error
+
+	if options.Interpreter == "" {
+		options.Interpreter = "python"
+	}
+
+	interpreterLookupPaths, reported, err = determineLookupPaths(options.Interpreter, options.UseSystemPaths)
+	if err != nil {
+		return nil, err
+	}
+	if options.VirtualEnv != nil {
+		interpreterLookupPaths = addVirtualEnvPaths(interpreterLookupPaths, options.VirtualEnv)
+	}
+
+	ret = new(BuildSession)
+	ret.options = options
+
+	if options.Wheelhouse != "" {
+
+		err = ret.unpackWheels()
+		if err != nil {
+			ret.Close()
+			return nil, err
+		}
+	}
+
+	paths = append(paths, options.SearchPaths...)
+	for _, wheel := range ret.wheels {
+		paths = append(paths, wheel.Path)
+	}
+	paths = append(paths, interpreterLookupPaths...)
+	paths = expandPathFiles(paths)
+
+	ret.lookupPaths = paths
+	ret.lookupFiles = determineLookupFiles(paths)
+	ret.cache = NewParseCache(options.CacheDirectory)
+	ret.stdlibModules = make(map[string]bool)
+
+	for _, name := range reported.Stdlib {
+		ret.stdlibModules[name] = true
+	}
+
+	for _, directory := range reported.StdlibDirectories {
+
+		directory, err := filepath.Abs(directory)
+		if err == nil {
+			ret.stdlibDirectories = append(ret.stdlibDirectories, directory)
+		}
+	}
+
+	return ret, nil
+}
+
+/*
+	Parses the given [inputPath], traverses and processes all dependent imports (combining as required),
+	and returns a context which can be used to compile a combined output.
+	If any error diagnostics were found, the returned error is a *DiagnosticError.
+*/
+func (this *BuildSession) Parse(inputPath string) (*BuildContext, error) {
+
+	var context *BuildContext
+	var err error
+
+	context = NewBuildContext(this)
+	context.entryPoint, err = filepath.Abs(inputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// combine in context
+	err = parse(inputPath, context)
+	if err != nil {
+		return nil, err
+	}
+
+	if context.HasErrors() {
+		return nil, &DiagnosticError{Diagnostics: context.GetDiagnostics(), Paths: context.getLinkedPaths()}
+	}
+
+	return context, nil
+}
+
+func (this *BuildSession) GetLookupPaths() []string {
+	return this.lookupPaths
+}
+
+/*
+	Re-reads the lookup directories, so that modules which have been added or removed since the session was made are accounted for.
+	Must not be called while a build from this session is running.
+*/
+func (this *BuildSession) RefreshLookupFiles() {
+	this.lookupFiles = determineLookupFiles(this.lookupPaths)
+}
+
+/*
+	Returns true if the given (absolute) [path] is directly within one of the interpreter's standard library directories.
+*/
+func (this *BuildSession) isStandardLibrary(path string) bool {
+
+	for _, directory := range this.stdlibDirectories {
+		if filepath.Dir(path) == directory {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Unpacks the wheels which the options' requirements file picks from their wheelhouse.
+	They're unpacked into the cache directory, so that each is only unpacked once, or otherwise into a temporary directory of this session's own.
+*/
+func (this *BuildSession) unpackWheels() error {
+
+	var directory string
+	var err error
+
+	if this.options.CacheDirectory != "" {
+
+		directory = filepath.Join(this.options.CacheDirectory, "wheels")
+		err = makePrivateDirectory(directory)
+	} else {
+
+		directory, err = ioutil.TempDir("", "coiler-wheels-")
+		this.temporaryDirectory = directory
+	}
+
+	if err == nil {
+		this.wheels, err = UnpackWheelhouse(this.options.Wheelhouse, this.options.RequirementsPath, directory, this.options.Interpreter)
+	}
+
+	if err != nil {
+
+		errorMsg := fmt.Sprintf("Unable to use wheelhouse: \n%v", err)
+		return errors.New(errorMsg)
+	}
+	return nil
+}
+
+/*
+	Removes whatever this session made which shouldn't outlive it. Builds from this session can't be compiled afterwards.
+*/
+func (this *BuildSession) Close() {
+
+	if this.temporaryDirectory != "" {
+		os.RemoveAll(this.temporaryDirectory)
+	}
+}
@@ -41,9 +41,12 @@ func (this *DependencyGraph) AddNode(file *FileContext) {
 func (this *DependencyGraph) GetOrderedNodes() []*FileContext {
 
 	var ret []*FileContext
+	var visited map[*DependencyGraphNode]bool
+
+	visited = make(map[*DependencyGraphNode]bool)
 
 	for _, node := range this.nodes {
-		ret = resolveDependency(node, ret)
+		ret = resolveDependency(node, ret, visited)
 	}
 
 	return ret
@@ -51,13 +54,19 @@ func (this *DependencyGraph) GetOrderedNodes() []*FileContext {
 
 /*
 	Solidifies the tree of dependencies.
+	Each imported module is matched to the file which provides it, rather than by namespace, since files can share a namespace.
 */
 func (this *DependencyGraph) DiscoverNeighbors() {
 
+	var path string
+
 	for _, node := range this.nodes {
 		for _, neighbor := range node.fileContext.dependencies {
+
+			path = node.fileContext.context.FindSourcePath(neighbor)
+
 			for _, possibleNeighbor := range this.nodes {
-				if possibleNeighbor.fileContext.namespace == neighbor {
+				if possibleNeighbor.fileContext.fullPath == path {
 
 					node.addNeighbor(possibleNeighbor)
 					break
@@ -67,10 +76,19 @@ func (this *DependencyGraph) DiscoverNeighbors() {
 	}
 }
 
-func resolveDependency(node *DependencyGraphNode, resolution []*FileContext) []*FileContext {
+/*
+	Appends the given [node] to [resolution] after everything it depends upon.
+	Nodes are only visited once, so that circular imports don't recurse forever.
+*/
+func resolveDependency(node *DependencyGraphNode, resolution []*FileContext, visited map[*DependencyGraphNode]bool) []*FileContext {
+
+	if visited[node] {
+		return resolution
+	}
+	visited[node] = true
 
 	for _, neighbor := range node.neighbors {
-		resolution = resolveDependency(neighbor, resolution)
+		resolution = resolveDependency(neighbor, resolution, visited)
 	}
 
 	if !elementExistsInSlice(node.fileContext, resolution) {
@@ -96,6 +114,12 @@ func (this *DependencyGraph) addDependency(source *DependencyGraphNode, target *
 }
 
 func (this *DependencyGraphNode) addNeighbor(neighbor *DependencyGraphNode) {
+
+	for _, existing := range this.neighbors {
+		if existing == neighbor {
+			return
+		}
+	}
 	this.neighbors = append(this.neighbors, neighbor)
 }
 
@@ -0,0 +1,180 @@
+package coiler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	SEVERITY_WARNING = "warning"
+	SEVERITY_ERROR   = "error"
+
+	// a 'from module import *' statement, which can't be combined.
+	DIAGNOSTIC_WILD_IMPORT = "wild-import"
+
+	// a module which was found, but couldn't be read or analyzed.
+	DIAGNOSTIC_UNREADABLE_MODULE = "unreadable-module"
+
+	// an import within an indented block, of a module which would otherwise have been combined.
+	DIAGNOSTIC_GUARDED_IMPORT = "guarded-import"
+
+	// a call to __import__ or import_module whose module can't be determined.
+	DIAGNOSTIC_DYNAMIC_IMPORT = "dynamic-import"
+
+	// two combined files which would share a namespace.
+	DIAGNOSTIC_MODULE_COLLISION = "module-collision"
+
+	// two different symbols which would be combined under the same name.
+	DIAGNOSTIC_SYMBOL_COLLISION = "symbol-collision"
+
+	// a name imported from a combined file which neither defines nor imports it.
+	DIAGNOSTIC_UNRESOLVED_IMPORT = "unresolved-import"
+
+	// a combined module which is also provided by a later lookup directory.
+	DIAGNOSTIC_SHADOWED_MODULE = "shadowed-module"
+
+	// a combined module, outside of the standard library, with the same name as a standard library module.
+	DIAGNOSTIC_SHADOWED_STDLIB = "shadowed-stdlib"
+
+	// an import of a package from a wheel, which can't be combined and won't exist at runtime.
+	DIAGNOSTIC_WHEEL_PACKAGE = "wheel-package"
+)
+
+/*
+	A single problem found while building, and where in the source it was found.
+*/
+type Diagnostic struct {
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	Path     string `json:"path"`
+
+	// 1-based. Zero if the diagnostic applies to the whole file.
+	Line   int `json:"line"`
+	Column int `json:"column"`
+
+	// the source line which the diagnostic refers to, if any.
+	Excerpt string `json:"excerpt,omitempty"`
+}
+
+/*
+	Returned when a build can't continue because of error diagnostics.
+	Contains every diagnostic found, including warnings.
+*/
+type DiagnosticError struct {
+	Diagnostics []Diagnostic
+
+	// the full path of every file linked into the build before it stopped; those which a fix could be made in.
+	Paths []string
+}
+
+func newDiagnostic(severity string, code string, path string, line int, column int, message string) Diagnostic {
+
+	var ret Diagnostic
+
+	ret = Diagnostic{
+		Severity: severity,
+		Code:     code,
+		Message:  message,
+		Path:     path,
+		Line:     line,
+		Column:   column,
+	}
+
+	ret.Excerpt = readSourceLine(path, line)
+	return ret
+}
+
+/*
+	Formats this diagnostic the way a compiler would; location, severity, message and code, followed by the offending line with a marker under the column.
+*/
+func (this Diagnostic) String() string {
+
+	var ret string
+	var marker []rune
+
+	if this.Line <= 0 {
+		return fmt.Sprintf("%s: %s: %s [%s]\n", this.Path, this.Severity, this.Message, this.Code)
+	}
+
+	ret = fmt.Sprintf("%s:%d:%d: %s: %s [%s]\n", this.Path, this.Line, this.Column, this.Severity, this.Message, this.Code)
+
+	if this.Excerpt == "" {
+		return ret
+	}
+
+	// keep tabs from the excerpt, so that the marker lines up regardless of tab width.
+	for i, character := range this.Excerpt {
+
+		if i >= this.Column-1 {
+			break
+		}
+
+		if character == '\t' {
+			marker = append(marker, '\t')
+		} else {
+			marker = append(marker, ' ')
+		}
+	}
+
+	return ret + fmt.Sprintf("    %s\n    %s^\n", this.Excerpt, string(marker))
+}
+
+func (this *DiagnosticError) Error() string {
+
+	var count int
+
+	for _, diagnostic := range this.Diagnostics {
+		if diagnostic.Severity == SEVERITY_ERROR {
+			count++
+		}
+	}
+
+	if count == 1 {
+		return "1 error found in source files"
+	}
+	return fmt.Sprintf("%d errors found in source files", count)
+}
+
+/*
+	Returns the given (1-based) [line] of the file at [path], or an empty string if it can't be read.
+*/
+func readSourceLine(path string, line int) string {
+
+	var contents []byte
+	var lines []string
+	var err error
+
+	if line <= 0 {
+		return ""
+	}
+
+	contents, err = readSourceFile(path)
+	if err != nil {
+		return ""
+	}
+
+	lines = strings.Split(string(contents), "\n")
+	if line > len(lines) {
+		return ""
+	}
+	return strings.TrimRight(lines[line-1], "\r")
+}
+
+/*
+	Orders the given [diagnostics] by location, so that they're reported the same way regardless of the order in which files were parsed.
+*/
+func sortDiagnostics(diagnostics []Diagnostic) {
+
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+
+		if diagnostics[i].Path != diagnostics[j].Path {
+			return diagnostics[i].Path < diagnostics[j].Path
+		}
+		if diagnostics[i].Line != diagnostics[j].Line {
+			return diagnostics[i].Line < diagnostics[j].Line
+		}
+		return diagnostics[i].Column < diagnostics[j].Column
+	})
+}
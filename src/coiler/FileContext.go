@@ -3,6 +3,7 @@ package coiler
 import (
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -19,11 +20,22 @@ type FileContext struct {
 	// value is the fully-qualified function/variable name
 	dependentSymbols map[string]string
 
+	// the 'from' import statement which imported each (unqualified) key of dependentSymbols, for reporting names which can't be resolved.
+	importStatements map[string]ImportStatement
+
+	// top-level imports of external modules, keyed by the (1-based) line they begin on.
+	externalImports map[int][]ImportStatement
+
+	// the local names of functions and classes, keyed by the (1-based) line after which they've been defined.
+	definitions map[int][]string
+
 	// the absolute path to the file being combined
 	fullPath string
 
 	// the namespace of the file (usually just the name).
 	namespace string
+
+	translator *lineTranslator
 }
 
 var invalidPythonCharacters *regexp.Regexp
@@ -43,6 +55,10 @@ func NewFileContext(path string, context *BuildContext) (*FileContext, error) {
 	ret = new(FileContext)
 	ret.localSymbols = make(map[string]string)
 	ret.dependentSymbols = make(map[string]string)
+	ret.importStatements = make(map[string]ImportStatement)
+	ret.definitions = make(map[int][]string)
+	ret.externalImports = make(map[int][]ImportStatement)
+	ret.translator = newLineTranslator(ret)
 
 	ret.fullPath, err = filepath.Abs(path)
 	if err != nil {
@@ -59,45 +75,48 @@ func NewFileContext(path string, context *BuildContext) (*FileContext, error) {
 
 /*
 	Translates a single line of source using the local symbol map.
+	Lines must be given in order, since strings and statements can span several lines.
 */
 func (this *FileContext) TranslateLine(line string) string {
+	return this.translator.translateLine(line)
+}
 
-	var keys []string
+/*
+	Translates the given fragment of [code] (which contains no strings or comments) using the local symbol map.
+	In files other than the entry point, module attributes are among the local symbols.
+*/
+func (this *FileContext) translateCode(code string) string {
 
-	// ignore any top-level imports (but leave imports that are mid-line, since they're probably conditional)
-	if strings.HasPrefix(line, "import") || (strings.HasPrefix(line, "from") && strings.Contains(line, "import")) {
-		return ""
-	}
+	var keys []string
+	var translated string
 
 	// TODO: handle multi-line imports
 	keys = orderMapKeysByLength(this.localSymbols)
 	for _, key := range keys {
-		line = replaceSymbol(line, key, this.context.TranslateSymbol(this.localSymbols[key]))
+		code = replaceSymbol(code, key, this.context.TranslateSymbol(this.localSymbols[key]))
 	}
 
+	// imported names which couldn't be resolved (and were reported as such) are left as they are.
 	keys = orderMapKeysByLength(this.dependentSymbols)
 	for _, key := range keys {
-		line = replaceSymbol(line, key, this.context.TranslateSymbol(this.dependentSymbols[key]))
+
+		translated = this.context.TranslateSymbol(this.dependentSymbols[key])
+		if translated != "" {
+			code = replaceSymbol(code, key, translated)
+		}
 	}
 
-	return line
+	return code
 }
 
 /*
 	Adds all symbols of the given [dependentContext] to this local symbol table,
-	prefixing them with the given [alias]
+	prefixing them with the given [alias]. This includes the names it imports itself, so that they can be re-exported.
 */
 func (this *FileContext) AliasContext(dependentContext *FileContext, alias string) {
 
-	var aliasedSymbol string
-	var bareSymbol string
-
-	for _, fullSymbol := range dependentContext.localSymbols {
-
-		bareSymbol = strings.Replace(fullSymbol, dependentContext.namespace+".", "", -1)
-		aliasedSymbol = alias + "." + bareSymbol
-
-		this.dependentSymbols[aliasedSymbol] = fullSymbol
+	for _, name := range dependentContext.GetModuleNames() {
+		this.dependentSymbols[alias+"."+name] = dependentContext.qualify(name)
 	}
 }
 
@@ -105,7 +124,7 @@ func (this *FileContext) AliasCall(dependentContext *FileContext, remoteName str
 
 	var fullSymbol string
 
-	fullSymbol = dependentContext.namespace + "." + remoteName
+	fullSymbol = dependentContext.qualify(remoteName)
 	this.dependentSymbols[aliasedName] = fullSymbol
 }
 
@@ -113,24 +132,88 @@ func (this *FileContext) UnaliasedCall(dependentContext *FileContext, remoteName
 
 	var fullSymbol string
 
-	fullSymbol = dependentContext.namespace + "." + remoteName
+	fullSymbol = dependentContext.qualify(remoteName)
 	this.dependentSymbols[remoteName] = fullSymbol
 }
 
+/*
+	Records that the given (unqualified) [localName] was imported by the given 'from' import [statement].
+*/
+func (this *FileContext) AddImportStatement(localName string, statement ImportStatement) {
+	this.importStatements[localName] = statement
+}
+
+/*
+	Returns every name bound in this file's module namespace, whether defined here or imported from another combined file, ordered by name.
+*/
+func (this *FileContext) GetModuleNames() []string {
+
+	var ret []string
+
+	for name, _ := range this.localSymbols {
+		ret = append(ret, name)
+	}
+
+	for name, _ := range this.dependentSymbols {
+
+		_, local := this.localSymbols[name]
+		if !local && !strings.Contains(name, ".") {
+			ret = append(ret, name)
+		}
+	}
+
+	sort.Strings(ret)
+	return ret
+}
+
+func (this *FileContext) GetNamespace() string {
+	return this.namespace
+}
+
+func (this *FileContext) GetPath() string {
+	return this.fullPath
+}
+
+func (this *FileContext) GetDependencies() []string {
+	return this.dependencies
+}
+
 func (this *FileContext) AddDependency(module string) {
 	this.dependencies = append(this.dependencies, module)
 }
 
+/*
+	Returns the fully-qualified form of the given [name], as defined by this file.
+	Qualified names are prefixed by the file's full path rather than its namespace, since two files may share a namespace.
+*/
+func (this *FileContext) qualify(name string) string {
+	return this.fullPath + "." + name
+}
+
 func (this *FileContext) AddLocalSymbol(localName string) string {
 
 	var qualifiedName string
 
-	qualifiedName = this.namespace + "." + localName
+	qualifiedName = this.qualify(localName)
 	this.localSymbols[localName] = qualifiedName
 
 	return qualifiedName
 }
 
+/*
+	Marks the given (already added) [localName] as a function or class, defined once the given [line] has run.
+*/
+func (this *FileContext) AddDefinition(localName string, line int) {
+	this.definitions[line] = append(this.definitions[line], localName)
+}
+
+/*
+	Records the given top-level import [statement] of an external module, to be written in place of the original.
+*/
+func (this *FileContext) AddExternalImport(statement ImportStatement) {
+	this.externalImports[statement.Line] = append(this.externalImports[statement.Line], statement)
+}
+
 /*
 	Returns a list of keys where the longest keys are given first, shortest last.
 */
@@ -168,7 +251,7 @@ func orderMapKeysByLength(source map[string]string) []string {
 
 /*
 	Replaces all occurrences of [symbol] in the given [line], as long as
-	it is not surrounded by valid python alphanumeric identifiers.
+	it is not surrounded by valid python alphanumeric identifiers, nor an attribute of something else.
 */
 func replaceSymbol(line string, symbol string, replacement string) string {
 
@@ -189,17 +272,15 @@ func replaceSymbol(line string, symbol string, replacement string) string {
 			return line
 		}
 
-		// TODO: make sure string literals (and comments?) don't get translated
-
 		startIndex += endIndex
 		endIndex = startIndex + len(symbol)
 
 		// if prefix is within range
-		if startIndex-1 > 0 {
+		if startIndex > 0 {
 
-			// if prefixed by an alphanumeric character
+			// if prefixed by an alphanumeric character, or a '.' (making it an attribute of something else)
 			prefix = []byte(line[startIndex-1 : startIndex])
-			if irreplaceableCharacters.Match(prefix) {
+			if irreplaceableCharacters.Match(prefix) || prefix[0] == '.' {
 
 				//fmt.Printf("Found a prefix replacement (%s) that shouldn't happen: line '%s', symbol: '%s'\n%d:%d\n\n", prefix, line, symbol, startIndex, endIndex)
 				continue
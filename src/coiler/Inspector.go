@@ -0,0 +1,123 @@
+package coiler
+
+/*
+	Handles inspection of existing outputs (either a combined *.pyc, or a native executable made by CreateBinary).
+*/
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+)
+
+/*
+	Describes the contents of a coiled artifact.
+*/
+type Inspection struct {
+	Path string
+
+	// true if the artifact is a native executable, false if it is a bare *.pyc
+	IsBinary bool
+
+	// only set for native executables
+	Footer *PayloadFooter
+
+	// the magic number at the start of the compiled python, and the python version it identifies.
+	Magic         uint16
+	PythonVersion string
+
+	// the build manifest, or nil if none could be found. If nil, ManifestError describes why.
+	Manifest      *BuildManifest
+	ManifestError error
+}
+
+/*
+	Known python bytecode magic numbers, and the (inclusive) highest magic number used by each version.
+*/
+var pythonMagicNumbers = []struct {
+	highest uint16
+	version string
+}{
+	{62131, "2.5"},
+	{62161, "2.6"},
+	{62211, "2.7"},
+	{3131, "3.0"},
+	{3151, "3.1"},
+	{3180, "3.2"},
+	{3230, "3.3"},
+	{3310, "3.4"},
+	{3351, "3.5"},
+	{3379, "3.6"},
+	{3394, "3.7"},
+	{3413, "3.8"},
+	{3425, "3.9"},
+	{3439, "3.10"},
+	{3495, "3.11"},
+	{3531, "3.12"},
+	{3571, "3.13"},
+}
+
+/*
+	Inspects the coiled artifact at the given [path].
+*/
+func Inspect(path string) (*Inspection, error) {
+
+	var ret *Inspection
+	var contents, pyc []byte
+	var err error
+
+	contents, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ret = new(Inspection)
+	ret.Path = path
+
+	ret.Footer, err = readPayloadFooter(contents)
+	if err == nil {
+
+		ret.IsBinary = true
+
+		pyc, err = ret.Footer.ExtractPayload(contents)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		pyc = contents
+	}
+
+	if len(pyc) < 4 || pyc[2] != '\r' || pyc[3] != '\n' {
+		return nil, errors.New("File is neither a coiled binary nor a compiled python file")
+	}
+
+	ret.Magic = binary.LittleEndian.Uint16(pyc)
+	ret.PythonVersion = pythonVersionForMagic(ret.Magic)
+	ret.Manifest, ret.ManifestError = ReadManifest(pyc)
+	return ret, nil
+}
+
+/*
+	Returns the python version which uses the given bytecode [magic] number.
+*/
+func pythonVersionForMagic(magic uint16) string {
+
+	var isPython2 bool
+
+	// python 2 and python 3 magic numbers are separate ranges; python 3 starts at 3000, python 2 at 20121.
+	if magic < 3000 {
+		return "unknown"
+	}
+	isPython2 = magic >= 20121
+
+	for _, known := range pythonMagicNumbers {
+
+		if (known.highest >= 20121) != isPython2 {
+			continue
+		}
+
+		if magic <= known.highest {
+			return known.version
+		}
+	}
+	return "unknown (newer than any known version)"
+}
@@ -0,0 +1,735 @@
+package coiler
+
+import (
+	"regexp"
+	"strings"
+)
+
+/*
+	Translates source a line at a time, keeping track of what each part of a line is.
+	Symbols are only replaced in code; strings and comments are left as they are, except for
+	the replacement fields of f-strings, and strings used as type annotations (forward references), which are code written as strings.
+*/
+type lineTranslator struct {
+	file *FileContext
+
+	// the quotes of a string which began on an earlier line and hasn't ended yet (empty if there isn't one), and whether it's an f-string.
+	openQuote     string
+	openFormatted bool
+
+	// every bracket which is open, outermost first.
+	brackets []openBracket
+
+	// code which has been read, but not yet translated.
+	code []byte
+
+	// the translation of a logical line which continues onto the next line, written once the logical line ends.
+	pending string
+
+	// true while reading a top-level import, which is left out.
+	dropping bool
+
+	// the first name of the current statement, and whether anything has been read since it began.
+	keyword string
+	started bool
+
+	// true once the current statement has an assignment or lambda at the top level, after which a colon can't begin a variable annotation.
+	assigned bool
+
+	// the number of brackets open within the parameter list of a def statement, or zero if not within one.
+	parameterDepth int
+	inDefault      bool
+
+	// the kind of annotation being read, ANNOTATION_NONE if not within one.
+	annotation int
+
+	// where, in the logical line being written, the current annotation began.
+	annotationStart int
+
+	// the last name read, so that 'Literal[' can be recognized.
+	lastName string
+
+	// which part of an import statement is being read, IMPORT_NONE if not within one.
+	importPart int
+
+	// true if the line being translated ends with a backslash, and so continues onto the next.
+	continued bool
+
+	// true if the file has 'from __future__ import annotations'.
+	// python would keep its annotations as strings, rather than evaluating them when they're defined, so they're written as strings.
+	postponed bool
+}
+
+type openBracket struct {
+	character byte
+
+	// true for the subscript of a 'Literal', whose strings are values rather than annotations.
+	isLiteral bool
+}
+
+const (
+	ANNOTATION_NONE = iota
+
+	// 'def f(x: T)'. Ends at the next ',', '=' or ')' of the parameter list.
+	ANNOTATION_PARAMETER
+
+	// 'def f() -> T:'. Ends at the colon which ends the header.
+	ANNOTATION_RETURN
+
+	// 'x: T = 1'. Ends at the '=', or the end of the statement.
+	ANNOTATION_VARIABLE
+
+	// the contents of a string annotation, which is an annotation all the way through.
+	ANNOTATION_STRING
+)
+
+const (
+	IMPORT_NONE = iota
+
+	// the module being imported from, or one of the modules being imported.
+	IMPORT_MODULE
+
+	// the names imported by a 'from' import.
+	IMPORT_NAMES
+
+	// the name after an 'as'.
+	IMPORT_ALIAS
+)
+
+var futureAnnotationsRegex *regexp.Regexp
+var importAliasRegex *regexp.Regexp
+var annotationTextRegex *regexp.Regexp
+var stringPrefixes map[string]bool
+var compoundKeywords map[string]bool
+
+func init() {
+
+	futureAnnotationsRegex = regexp.MustCompile("^from\\s+__future__\\s+import\\s+.*\\bannotations\\b")
+	importAliasRegex = regexp.MustCompile("^\\s+as\\b")
+
+	// only strings which could be an expression of names are translated as annotations; 'Optional[Node]', 'list["Node"]', 'A | B'
+	annotationTextRegex = regexp.MustCompile("^[a-zA-Z0-9_.,\\[\\]|()'\" ]*[a-zA-Z_][a-zA-Z0-9_.,\\[\\]|()'\" ]*$")
+
+	stringPrefixes = make(map[string]bool)
+	for _, prefix := range strings.Fields("r u b f br rb fr rf") {
+		stringPrefixes[prefix] = true
+	}
+
+	compoundKeywords = make(map[string]bool)
+	for _, keyword := range strings.Fields("if elif else while for try except finally with def class match case lambda") {
+		compoundKeywords[keyword] = true
+	}
+}
+
+func newLineTranslator(file *FileContext) *lineTranslator {
+
+	var ret *lineTranslator
+
+	ret = new(lineTranslator)
+	ret.file = file
+	return ret
+}
+
+/*
+	Translates the given [line] (including its line ending), which follows whichever lines were translated before it.
+	Since an annotation can only be written as a string once it has ended, lines are only returned once their logical line has ended;
+	until then, an empty string is returned. Top-level imports are removed entirely.
+*/
+func (this *lineTranslator) translateLine(line string) string {
+
+	var ret, body, ending string
+
+	body = strings.TrimRight(line, "\r\n")
+	ending = line[len(body):]
+	this.continued = false
+
+	if this.pending == "" && this.openQuote == "" {
+
+		if futureAnnotationsRegex.MatchString(body) {
+			this.postponed = true
+		}
+
+		// ignore any top-level imports (but leave imports that are mid-line, since they're probably conditional)
+		// external modules are imported again by the writer, in place of the line.
+		if topLevelImportRegex.MatchString(body) && strings.Contains(body, "import") {
+			this.dropping = true
+		}
+	}
+
+	ret = this.translate(this.pending, body)
+
+	if this.openQuote != "" || len(this.brackets) > 0 || this.continued {
+		this.pending = ret + ending
+		return ""
+	}
+
+	// the end of a logical line, and so of the statement.
+	if this.annotation == ANNOTATION_VARIABLE {
+		ret = this.endAnnotation(ret)
+	}
+
+	this.endStatement()
+	this.pending = ""
+
+	// the import is still read through to its end, since it may continue onto other lines.
+	if this.dropping {
+
+		this.dropping = false
+		return ""
+	}
+	return ret + ending
+}
+
+/*
+	Returns true if a logical line has been started, but not yet returned by translateLine.
+*/
+func (this *lineTranslator) isPending() bool {
+	return this.pending != ""
+}
+
+/*
+	Translates the given [text], which is (part of) a single line, and appends it to [ret].
+*/
+func (this *lineTranslator) translate(ret string, text string) string {
+
+	var name string
+	var character byte
+
+	for i := 0; i < len(text); {
+
+		if this.openQuote != "" {
+
+			ret += this.flushCode()
+			ret, i = this.continueString(ret, text, i)
+			continue
+		}
+
+		character = text[i]
+
+		switch {
+		case character == '#':
+
+			ret += this.flushCode()
+
+			// nothing can follow a comment on the same line, so a statement's annotation ends here.
+			if this.annotation == ANNOTATION_VARIABLE && len(this.brackets) == 0 {
+				ret = this.endAnnotation(ret)
+			}
+
+			ret += text[i:]
+			i = len(text)
+
+		case character == '"' || character == '\'':
+
+			ret += this.flushCode()
+			ret, i = this.beginString(ret, text, i, "")
+
+		case isIdentifierStart(character):
+
+			name = identifierRegex.FindString(text[i:])
+
+			if i+len(name) < len(text) && (text[i+len(name)] == '"' || text[i+len(name)] == '\'') && stringPrefixes[strings.ToLower(name)] {
+
+				ret += this.flushCode()
+				ret, i = this.beginString(ret, text, i+len(name), name)
+				continue
+			}
+
+			this.readName(name)
+
+			if this.keyword == "import" || this.keyword == "from" {
+				ret += this.flushCode() + this.translateImportName(name, text[i+len(name):])
+			} else {
+				this.code = append(this.code, name...)
+			}
+			i += len(name)
+
+		case character >= '0' && character <= '9':
+
+			// numbers can contain letters ('1e5', '0xff'), which mustn't be read as names.
+			for i < len(text) && (isIdentifierCharacter(text[i]) || text[i] == '.') {
+				this.code = append(this.code, text[i])
+				i++
+			}
+			this.started = true
+
+		default:
+			ret, i = this.readPunctuation(ret, text, i)
+		}
+	}
+
+	return ret + this.flushCode()
+}
+
+func (this *lineTranslator) readName(name string) {
+
+	this.lastName = name
+
+	if !this.started && name != "async" {
+		this.keyword = name
+		this.started = true
+	}
+
+	if name == "lambda" && len(this.brackets) == 0 {
+		this.assigned = true
+	}
+}
+
+/*
+	Translates the given [name] within an import statement (which is only translated if it isn't at the top level), followed by the given [rest] of the line.
+	Module names are left alone. Names imported from a module are imported as their translation (if they have one), since that's what they're called here.
+*/
+func (this *lineTranslator) translateImportName(name string, rest string) string {
+
+	var translated string
+
+	switch {
+	case this.importPart == IMPORT_NONE:
+		this.importPart = IMPORT_MODULE
+
+	case name == "import" && this.keyword == "from":
+		this.importPart = IMPORT_NAMES
+
+	case name == "as":
+		this.importPart = IMPORT_ALIAS
+
+	case this.importPart == IMPORT_ALIAS:
+
+		this.importPart = IMPORT_MODULE
+		if this.keyword == "from" {
+			this.importPart = IMPORT_NAMES
+		}
+		return this.file.translateCode(name)
+
+	case this.importPart == IMPORT_NAMES:
+
+		translated = this.file.translateCode(name)
+		if translated != name && !importAliasRegex.MatchString(rest) {
+			return name + " as " + translated
+		}
+	}
+	return name
+}
+
+/*
+	Reads the operator or bracket at [i] of the given [text], which is written after [written].
+	Returns everything written so far, and the index just after whatever was read.
+*/
+func (this *lineTranslator) readPunctuation(written string, text string, i int) (string, int) {
+
+	var character, next byte
+	var depth int
+	var lastName string
+
+	character = text[i]
+	if i+1 < len(text) {
+		next = text[i+1]
+	}
+	depth = len(this.brackets)
+	lastName = this.lastName
+
+	if character != ' ' && character != '\t' {
+
+		this.started = true
+		if character != '.' {
+			this.lastName = ""
+		}
+	}
+
+	switch {
+	case character == '(' || character == '[' || character == '{':
+
+		this.brackets = append(this.brackets, openBracket{character: character, isLiteral: character == '[' && lastName == "Literal"})
+
+		if character == '(' && this.keyword == "def" && depth == 0 && this.parameterDepth == 0 && this.annotation == ANNOTATION_NONE {
+			this.parameterDepth = len(this.brackets)
+			this.inDefault = false
+		}
+
+	case character == ')' || character == ']' || character == '}':
+
+		if this.annotation == ANNOTATION_PARAMETER && depth == this.parameterDepth {
+			written = this.endAnnotation(written + this.flushCode())
+		}
+
+		if depth == this.parameterDepth {
+			this.parameterDepth = 0
+		}
+
+		if depth > 0 {
+			this.brackets = this.brackets[:depth-1]
+		}
+
+	case character == ',':
+
+		if this.annotation == ANNOTATION_PARAMETER && depth == this.parameterDepth {
+			written = this.endAnnotation(written + this.flushCode())
+		}
+
+		if depth == this.parameterDepth {
+			this.inDefault = false
+		}
+
+	case character == '-' && next == '>':
+
+		this.code = append(this.code, "->"...)
+
+		if this.keyword == "def" && depth == 0 {
+			written = this.beginAnnotation(written, ANNOTATION_RETURN)
+		}
+		return written, i + 2
+
+	case character == ':' && next == '=':
+
+		// assignment expression
+		this.code = append(this.code, ":="...)
+		return written, i + 2
+
+	case character == ':' && this.annotation == ANNOTATION_RETURN && depth == 0:
+
+		// the end of a def statement's header
+		written = this.endAnnotation(written + this.flushCode())
+
+		this.code = append(this.code, ':')
+		this.endStatement()
+		return written, i + 1
+
+	case character == ':':
+
+		this.code = append(this.code, ':')
+
+		switch {
+		case depth == 0 && compoundKeywords[this.keyword] && this.keyword != "lambda":
+
+			// the end of a compound statement's header; anything after it on the same line is a statement of its own.
+			this.endStatement()
+
+		case depth == 0 && this.annotation == ANNOTATION_NONE && !this.assigned && this.keyword != "" && !compoundKeywords[this.keyword]:
+			written = this.beginAnnotation(written, ANNOTATION_VARIABLE)
+
+		case depth > 0 && depth == this.parameterDepth && !this.inDefault && this.annotation == ANNOTATION_NONE:
+			written = this.beginAnnotation(written, ANNOTATION_PARAMETER)
+		}
+		return written, i + 1
+
+	case character == '=' && next == '=':
+
+		this.code = append(this.code, "=="...)
+		return written, i + 2
+
+	case strings.IndexByte("<>!+-*/%&|^@", character) >= 0 && next == '=':
+
+		// comparisons and augmented assignments
+		if depth == 0 {
+			this.assigned = true
+		}
+
+		this.code = append(this.code, character, next)
+		return written, i + 2
+
+	case character == '=':
+
+		if (this.annotation == ANNOTATION_VARIABLE && depth == 0) || (this.annotation == ANNOTATION_PARAMETER && depth == this.parameterDepth) {
+			written = this.endAnnotation(written + this.flushCode())
+		}
+
+		if depth == 0 {
+			this.assigned = true
+		}
+
+		if depth > 0 && depth == this.parameterDepth {
+			this.inDefault = true
+		}
+
+	case character == '\\' && i == len(text)-1:
+
+		// explicit line continuation
+		this.continued = true
+
+	case character == ';' && depth == 0:
+
+		if this.annotation == ANNOTATION_VARIABLE {
+			written = this.endAnnotation(written + this.flushCode())
+		}
+
+		this.code = append(this.code, ';')
+		this.endStatement()
+		return written, i + 1
+	}
+
+	this.code = append(this.code, character)
+	return written, i + 1
+}
+
+/*
+	Writes the string literal whose opening quote is at [start] of the given [text], preceded by the given [prefix] ('r', 'f', 'b', and so on).
+	Returns everything written so far, and the index just after the string (or the end of the line, if the string continues onto the next one).
+*/
+func (this *lineTranslator) beginString(written string, text string, start int, prefix string) (string, int) {
+
+	var quote, contents string
+	var end int
+	var closed, formatted, isAnnotation bool
+
+	quote = text[start : start+1]
+	if strings.HasPrefix(text[start:], strings.Repeat(quote, 3)) {
+		quote = strings.Repeat(quote, 3)
+	}
+
+	formatted = strings.ContainsAny(prefix, "fF")
+	isAnnotation = this.annotation != ANNOTATION_NONE && !this.inLiteral() && !strings.ContainsAny(prefix, "bB")
+
+	end, closed = findStringEnd(text, start+len(quote), quote)
+	contents = text[start+len(quote) : end]
+
+	this.started = true
+	written += prefix + quote
+
+	switch {
+	case formatted:
+		written += this.translateFormatFields(contents)
+
+	case isAnnotation && closed && annotationTextRegex.MatchString(contents):
+		written += this.translateAnnotationText(contents)
+
+	default:
+		written += contents
+	}
+
+	if !closed {
+
+		// only a backslash can continue a single-quoted string onto the next line.
+		if len(quote) == 3 || strings.HasSuffix(text, "\\") {
+			this.openQuote = quote
+			this.openFormatted = formatted
+		}
+		return written, len(text)
+	}
+	return written + quote, end + len(quote)
+}
+
+/*
+	Writes the rest of a string which began on an earlier line, starting at [start] of the given [text].
+*/
+func (this *lineTranslator) continueString(written string, text string, start int) (string, int) {
+
+	var contents string
+	var end int
+	var closed bool
+
+	end, closed = findStringEnd(text, start, this.openQuote)
+	contents = text[start:end]
+
+	if this.openFormatted {
+		written += this.translateFormatFields(contents)
+	} else {
+		written += contents
+	}
+
+	if !closed {
+
+		if len(this.openQuote) == 1 && !strings.HasSuffix(text, "\\") {
+			this.openQuote = ""
+		}
+		return written, len(text)
+	}
+
+	written += this.openQuote
+	end += len(this.openQuote)
+	this.openQuote = ""
+	return written, end
+}
+
+/*
+	Returns the index of the closing [quote] of a string in [text] whose contents start at [start], and whether it was found at all.
+	If it wasn't, the index is the end of the text.
+*/
+func findStringEnd(text string, start int, quote string) (int, bool) {
+
+	for i := start; i < len(text); i++ {
+
+		if text[i] == '\\' {
+			i++
+			continue
+		}
+
+		if strings.HasPrefix(text[i:], quote) {
+			return i, true
+		}
+	}
+	return len(text), false
+}
+
+/*
+	Translates the replacement fields ('{name}') of the given [contents] of an f-string. Escaped braces ('{{') are left alone.
+*/
+func (this *lineTranslator) translateFormatFields(contents string) string {
+
+	var ret string
+	var depth, fieldStart int
+
+	for i := 0; i < len(contents); i++ {
+
+		switch {
+		case depth == 0 && strings.HasPrefix(contents[i:], "{{"), depth == 0 && strings.HasPrefix(contents[i:], "}}"):
+
+			ret += contents[i : i+2]
+			i++
+
+		case contents[i] == '{':
+
+			if depth == 0 {
+				ret += "{"
+				fieldStart = i + 1
+			}
+			depth++
+
+		case contents[i] == '}' && depth > 0:
+
+			depth--
+			if depth == 0 {
+				ret += this.file.translateCode(contents[fieldStart:i]) + "}"
+			}
+
+		case depth == 0:
+			ret += contents[i : i+1]
+		}
+	}
+
+	// a field which continues onto the next line.
+	if depth > 0 {
+		ret += this.file.translateCode(contents[fieldStart:])
+	}
+	return ret
+}
+
+/*
+	Translates the given [contents] of a string annotation as the expression it represents.
+*/
+func (this *lineTranslator) translateAnnotationText(contents string) string {
+
+	var translator *lineTranslator
+
+	translator = newLineTranslator(this.file)
+	translator.annotation = ANNOTATION_STRING
+	translator.started = true
+
+	return translator.translate("", contents)
+}
+
+/*
+	Returns true if the innermost subscript being read is that of a 'Literal'.
+*/
+func (this *lineTranslator) inLiteral() bool {
+
+	for _, bracket := range this.brackets {
+		if bracket.isLiteral {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Translates any code which has been read but not yet written.
+*/
+func (this *lineTranslator) flushCode() string {
+
+	var ret string
+
+	if len(this.code) == 0 {
+		return ""
+	}
+
+	ret = this.file.translateCode(string(this.code))
+	this.code = this.code[:0]
+	return ret
+}
+
+/*
+	Begins an annotation of the given [kind], just after the (not yet written) code that introduces it.
+*/
+func (this *lineTranslator) beginAnnotation(written string, kind int) string {
+
+	written += this.flushCode()
+
+	this.annotation = kind
+	this.annotationStart = len(written)
+	return written
+}
+
+/*
+	Ends the current annotation, which is at the end of the given [written] text.
+	If the file's annotations are postponed, the annotation is turned into a string.
+*/
+func (this *lineTranslator) endAnnotation(written string) string {
+
+	var annotation, trimmed, quote string
+
+	start := this.annotationStart
+	this.annotation = ANNOTATION_NONE
+
+	if !this.postponed || start > len(written) {
+		return written
+	}
+
+	annotation = written[start:]
+	trimmed = strings.TrimSpace(annotation)
+
+	// annotations which span several lines are left alone, since a string can't.
+	switch {
+	case trimmed == "" || strings.ContainsAny(trimmed, "\\#\n") || isStringLiteral(trimmed):
+		return written
+	case !strings.Contains(trimmed, "\""):
+		quote = "\""
+	case !strings.Contains(trimmed, "'"):
+		quote = "'"
+	default:
+		return written
+	}
+
+	leading := annotation[:strings.Index(annotation, trimmed)]
+	trailing := annotation[len(leading)+len(trimmed):]
+
+	return written[:start] + leading + quote + trimmed + quote + trailing
+}
+
+/*
+	Returns true if the given [text] is a single string literal (which is left as it is, rather than being put in another string).
+*/
+func isStringLiteral(text string) bool {
+
+	var quote, name string
+	var end int
+	var closed bool
+
+	name = identifierRegex.FindString(text)
+	if name != "" && !stringPrefixes[strings.ToLower(name)] {
+		return false
+	}
+	text = text[len(name):]
+
+	if text == "" || (text[0] != '"' && text[0] != '\'') {
+		return false
+	}
+
+	quote = text[0:1]
+	if strings.HasPrefix(text, strings.Repeat(quote, 3)) {
+		quote = strings.Repeat(quote, 3)
+	}
+
+	end, closed = findStringEnd(text, len(quote), quote)
+	return closed && end+len(quote) == len(text)
+}
+
+func (this *lineTranslator) endStatement() {
+
+	this.keyword = ""
+	this.started = false
+	this.assigned = false
+	this.parameterDepth = 0
+	this.inDefault = false
+	this.annotation = ANNOTATION_NONE
+	this.importPart = IMPORT_NONE
+	this.lastName = ""
+}
@@ -0,0 +1,243 @@
+package coiler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// symbols are translated as 'namespace_ZC_symbol'. Readable, but two different symbols can translate to the same name.
+	MANGLE_SEPARATOR = "separator"
+
+	// symbols are suffixed with a short hash of their file's path; 'namespace_ZC_symbol_ZC_1a2b3c4d'
+	MANGLE_HASH = "hash"
+
+	// symbols are suffixed with the index of their file in the build; 'namespace_ZC_symbol_ZC_3'
+	MANGLE_INDEX = "index"
+
+	MANGLE_HASH_LENGTH = 8
+)
+
+/*
+	A top-level symbol, as defined by a combined file.
+*/
+type symbolDefinition struct {
+	qualifiedName string
+	file          *FileContext
+	line          int
+	column        int
+}
+
+/*
+	Translates every symbol defined in this build, according to the build's mangling scheme.
+	Must only be called once every file has been linked, since some schemes depend upon the order of files.
+	Adds an error diagnostic if two different symbols would translate to the same name, or (when symbols are only separated by namespace)
+	if two combined files share a namespace.
+	Returns an error only if the mangling scheme is unknown.
+*/
+func (this *BuildContext) resolveSymbols() error {
+
+	var files, namespaces map[string]*FileContext
+	var indexes map[*FileContext]int
+	var translations map[string]symbolDefinition
+	var definitions []symbolDefinition
+	var diagnostics []Diagnostic
+	var names []string
+	var translated, message, mangling string
+	var err error
+
+	// AddDiagnostic takes the lock, so diagnostics are only added once it has been released.
+	defer func() {
+		for _, diagnostic := range diagnostics {
+			this.AddDiagnostic(diagnostic)
+		}
+	}()
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	mangling = this.options.Mangling
+	if mangling == "" {
+		mangling = MANGLE_SEPARATOR
+	}
+
+	files = make(map[string]*FileContext)
+	namespaces = make(map[string]*FileContext)
+	indexes = make(map[*FileContext]int)
+
+	for index, node := range this.dependencies.nodes {
+
+		files[node.fileContext.fullPath] = node.fileContext
+		indexes[node.fileContext] = index
+
+		// under the other schemes, symbols of the two files are told apart by their suffix.
+		existing, found := namespaces[node.fileContext.namespace]
+		if found && mangling == MANGLE_SEPARATOR {
+
+			message = fmt.Sprintf("'%s' would be combined as '%s', which is already used by '%s'. Try a different mangling scheme", node.fileContext.fullPath, node.fileContext.namespace, existing.fullPath)
+			diagnostics = append(diagnostics, newDiagnostic(SEVERITY_ERROR, DIAGNOSTIC_MODULE_COLLISION, node.fileContext.fullPath, 0, 0, message))
+			continue
+		}
+
+		namespaces[node.fileContext.namespace] = node.fileContext
+	}
+
+	// definitions were added by several workers, put them into a stable order so that the first definition of a symbol is always the one reported.
+	definitions = append(definitions, this.definitions...)
+	sort.SliceStable(definitions, func(i, j int) bool {
+
+		if indexes[definitions[i].file] != indexes[definitions[j].file] {
+			return indexes[definitions[i].file] < indexes[definitions[j].file]
+		}
+		return definitions[i].line < definitions[j].line
+	})
+
+	translations = make(map[string]symbolDefinition)
+	this.symbols = make(map[string]string)
+
+	for _, definition := range definitions {
+
+		// redefinitions of a symbol within the same file
+		if _, exists := this.symbols[definition.qualifiedName]; exists {
+			continue
+		}
+
+		translated, err = mangleSymbol(mangling, definition, indexes[definition.file])
+		if err != nil {
+			return err
+		}
+
+		existing, found := translations[translated]
+		if found {
+
+			message = fmt.Sprintf("'%s' would be combined as '%s', which is already used by '%s' (%s:%d:%d). Try a different mangling scheme",
+				definition.displayName(), translated, existing.displayName(), existing.file.fullPath, existing.line, existing.column)
+
+			diagnostics = append(diagnostics, newDiagnostic(SEVERITY_ERROR, DIAGNOSTIC_SYMBOL_COLLISION, definition.file.fullPath, definition.line, definition.column, message))
+			continue
+		}
+
+		translations[translated] = definition
+		this.symbols[definition.qualifiedName] = translated
+	}
+
+	// names which files import from other combined files, which may themselves have imported them from elsewhere.
+	for _, node := range this.dependencies.nodes {
+
+		context := node.fileContext
+
+		names = nil
+		for name, _ := range context.dependentSymbols {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+
+			if this.resolveImportedSymbol(context.dependentSymbols[name], files, make(map[string]bool)) != "" {
+				continue
+			}
+
+			statement, found := context.importStatements[name]
+			if found {
+
+				message = fmt.Sprintf("'%s' isn't defined by '%s', or by any combined file it imports it from, so it's left untranslated", statement.Name, statement.Module)
+				diagnostics = append(diagnostics, newDiagnostic(SEVERITY_WARNING, DIAGNOSTIC_UNRESOLVED_IMPORT, context.fullPath, statement.Line, statement.Column, message))
+			}
+		}
+
+		// names this file imports may be looked up on its module, if it's registered.
+		for _, name := range context.GetModuleNames() {
+			this.resolveImportedSymbol(context.qualify(name), files, make(map[string]bool))
+		}
+	}
+	return nil
+}
+
+/*
+	Finds the translation of the given [qualifiedName], following it through any number of files which import (and so re-export) it
+	until it reaches the file which defines it. Files are found by their full paths, in [files]. [visited] guards against circular imports.
+	Re-exported names are added to the translated symbols as they're found. Returns an empty string if the name can't be resolved.
+	The caller must hold the lock.
+*/
+func (this *BuildContext) resolveImportedSymbol(qualifiedName string, files map[string]*FileContext, visited map[string]bool) string {
+
+	var context *FileContext
+	var ret, imported string
+	var separator int
+	var found bool
+
+	ret, found = this.symbols[qualifiedName]
+	if found || visited[qualifiedName] {
+		return ret
+	}
+	visited[qualifiedName] = true
+
+	// qualified names are prefixed by a path, which may itself contain dots. Names never do.
+	separator = strings.LastIndex(qualifiedName, ".")
+	if separator < 0 {
+		return ""
+	}
+
+	context = files[qualifiedName[:separator]]
+	if context == nil {
+		return ""
+	}
+
+	imported, found = context.dependentSymbols[qualifiedName[separator+1:]]
+	if !found {
+		return ""
+	}
+
+	ret = this.resolveImportedSymbol(imported, files, visited)
+	if ret != "" {
+		this.symbols[qualifiedName] = ret
+	}
+	return ret
+}
+
+/*
+	Returns the name of the given [definition] as it's written in python; its file's namespace, and the symbol itself.
+*/
+func (this symbolDefinition) displayName() string {
+	return this.file.namespace + "." + this.name()
+}
+
+/*
+	Returns the unqualified name of this definition.
+*/
+func (this symbolDefinition) name() string {
+	return this.qualifiedName[strings.LastIndex(this.qualifiedName, ".")+1:]
+}
+
+/*
+	Translates the given [definition] into a name suitable for use in combined files, using the given [scheme].
+	[index] is the position of the definition's file within the build.
+	Since two files can share a namespace, the hash and index schemes identify the file itself (by its full path, or its position).
+*/
+func mangleSymbol(scheme string, definition symbolDefinition, index int) (string, error) {
+
+	var ret string
+	var hash [sha256.Size]byte
+
+	ret = definition.file.namespace + NAMESPACE_SEPARATOR + definition.name()
+
+	switch scheme {
+	case "", MANGLE_SEPARATOR:
+		return ret, nil
+
+	case MANGLE_HASH:
+		hash = sha256.Sum256([]byte(definition.file.fullPath))
+		return ret + NAMESPACE_SEPARATOR + hex.EncodeToString(hash[:])[:MANGLE_HASH_LENGTH], nil
+
+	case MANGLE_INDEX:
+		return fmt.Sprintf("%s%s%d", ret, NAMESPACE_SEPARATOR, index), nil
+	}
+
+	errorMsg := fmt.Sprintf("Unknown mangling scheme '%s'. Expected one of '%s', '%s', or '%s'", scheme, MANGLE_SEPARATOR, MANGLE_HASH, MANGLE_INDEX)
+	return "", errors.New(errorMsg)
+}
@@ -0,0 +1,148 @@
+package coiler
+
+/*
+	Handles the build manifest, which is embedded in every combined file so that a shipped artifact can describe how it was made.
+	The manifest is written as a python string constant, which survives compilation verbatim inside the *.pyc.
+*/
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	VERSION = "1.0"
+
+	// precedes the JSON-encoded manifest, both in source and in compiled bytecode.
+	MANIFEST_MARKER = "COILER-MANIFEST:"
+
+	// the name of the module-level variable which holds the manifest in a combined file.
+	MANIFEST_SYMBOL = "__coiler_manifest__"
+)
+
+type BuildManifest struct {
+	CoilerVersion string           `json:"coilerVersion"`
+	EntryPoint    string           `json:"entryPoint"`
+	Modules       []ManifestModule `json:"modules"`
+	External      []string         `json:"external"`
+}
+
+/*
+	Describes a single source file which was combined into the output.
+*/
+type ManifestModule struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+
+	// the sha256 of the original source, hex-encoded.
+	Hash string `json:"sha256"`
+}
+
+/*
+	Creates a manifest describing the given [fileContexts], as combined by the given [buildContext].
+*/
+func NewBuildManifest(buildContext *BuildContext, fileContexts []*FileContext) (*BuildManifest, error) {
+
+	var ret *BuildManifest
+	var contents []byte
+	var hash [sha256.Size]byte
+	var err error
+
+	ret = new(BuildManifest)
+	ret.CoilerVersion = VERSION
+	ret.EntryPoint = buildContext.entryPoint
+	ret.External = append([]string{}, buildContext.externalDependencies...)
+
+	for _, context := range fileContexts {
+
+		contents, err = readSourceFile(context.fullPath)
+		if err != nil {
+			return nil, err
+		}
+
+		hash = sha256.Sum256(contents)
+		ret.Modules = append(ret.Modules, ManifestModule{
+			Name: context.namespace,
+			Path: context.fullPath,
+			Hash: hex.EncodeToString(hash[:]),
+		})
+	}
+
+	return ret, nil
+}
+
+/*
+	Returns a line of python source which assigns this manifest to MANIFEST_SYMBOL.
+*/
+func (this *BuildManifest) SourceLine() (string, error) {
+
+	var encoded []byte
+	var literal string
+	var err error
+
+	encoded, err = json.Marshal(this)
+	if err != nil {
+		return "", err
+	}
+
+	// keep the literal pure ascii, so that it is stored byte-for-byte regardless of python version or source encoding.
+	literal = asciiJSON(string(encoded))
+	literal = strings.Replace(literal, "\\", "\\\\", -1)
+	literal = strings.Replace(literal, "'", "\\'", -1)
+
+	return fmt.Sprintf("%s = '%s%s'\n", MANIFEST_SYMBOL, MANIFEST_MARKER, literal), nil
+}
+
+/*
+	Finds and decodes the manifest inside the given compiled [pyc] contents.
+*/
+func ReadManifest(pyc []byte) (*BuildManifest, error) {
+
+	var ret *BuildManifest
+	var decoder *json.Decoder
+	var index int
+	var err error
+
+	index = bytes.Index(pyc, []byte(MANIFEST_MARKER))
+	if index < 0 {
+		return nil, errors.New("No build manifest found, the file was not made by coiler or predates manifests")
+	}
+
+	ret = new(BuildManifest)
+	decoder = json.NewDecoder(bytes.NewReader(pyc[index+len(MANIFEST_MARKER):]))
+
+	err = decoder.Decode(ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+/*
+	Escapes every non-ascii character in the given JSON [source].
+*/
+func asciiJSON(source string) string {
+
+	var buffer bytes.Buffer
+
+	for _, character := range source {
+
+		if character < 128 {
+			buffer.WriteRune(character)
+			continue
+		}
+
+		if character > 0xFFFF {
+			// encode as a UTF-16 surrogate pair, as JSON requires.
+			character -= 0x10000
+			buffer.WriteString(fmt.Sprintf("\\u%04x\\u%04x", 0xD800+(character>>10), 0xDC00+(character&0x3FF)))
+			continue
+		}
+		buffer.WriteString(fmt.Sprintf("\\u%04x", character))
+	}
+	return buffer.String()
+}
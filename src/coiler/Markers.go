@@ -0,0 +1,409 @@
+package coiler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// reports the values of the environment markers (PEP 508) of the interpreter it's run by.
+	// python 2 has no sys.implementation, so its implementation's name is taken from the platform module instead.
+	MARKER_ENVIRONMENT_SCRIPT = `
+import json, os, platform, sys
+implementation = getattr(sys, 'implementation', None)
+if implementation is None:
+	name, version = platform.python_implementation().lower(), platform.python_version()
+else:
+	name, version = implementation.name, '%d.%d.%d' % implementation.version[:3]
+	if implementation.version.releaselevel != 'final':
+		version += implementation.version.releaselevel[0] + str(implementation.version.serial)
+print(json.dumps({
+	'python_version': '%d.%d' % sys.version_info[:2],
+	'python_full_version': platform.python_version(),
+	'sys_platform': sys.platform,
+	'platform_system': platform.system(),
+	'platform_machine': platform.machine(),
+	'platform_release': platform.release(),
+	'platform_version': platform.version(),
+	'platform_python_implementation': platform.python_implementation(),
+	'os_name': os.name,
+	'implementation_name': name,
+	'implementation_version': version,
+}))
+`
+)
+
+/*
+	The values of environment markers for a single interpreter, keyed by marker name ('python_version', 'sys_platform', etc).
+*/
+type markerEnvironment map[string]string
+
+/*
+	A parsed environment marker, such as 'python_version < "3.8" and sys_platform == "win32"'.
+	Either combines other markers (when [operator] is 'and' or 'or'), or compares two values.
+*/
+type markerExpression struct {
+	operator string
+
+	// for 'and' and 'or', the markers combined.
+	operands []*markerExpression
+
+	// for comparisons, the values compared.
+	left  markerValue
+	right markerValue
+}
+
+/*
+	One side of a marker comparison; either the name of a marker variable, or a literal string.
+*/
+type markerValue struct {
+	variable string
+	literal  string
+}
+
+type markerToken struct {
+
+	// one of '(', ')', 's' (a string), 'i' (an identifier or keyword), or 'o' (a comparison operator).
+	kind byte
+	text string
+}
+
+/*
+	Runs the given [interpreter] to find the values of its environment markers.
+*/
+func readMarkerEnvironment(interpreter string) (markerEnvironment, error) {
+
+	var ret markerEnvironment
+	var output []byte
+	var err error
+
+	output, err = exec.Command(interpreter, "-c", MARKER_ENVIRONMENT_SCRIPT).Output()
+	if err != nil {
+
+		errorMsg := fmt.Sprintf("Unable to read the environment of '%s': %v", interpreter, err)
+		return nil, errors.New(errorMsg)
+	}
+
+	err = json.Unmarshal(output, &ret)
+	if err != nil {
+
+		errorMsg := fmt.Sprintf("Unable to read the environment of '%s': %v", interpreter, err)
+		return nil, errors.New(errorMsg)
+	}
+	return ret, nil
+}
+
+/*
+	Parses the given environment [marker], which follows the ';' of a requirement.
+*/
+func parseMarker(marker string) (*markerExpression, error) {
+
+	var ret *markerExpression
+	var tokens []markerToken
+	var position int
+	var err error
+
+	tokens, err = tokenizeMarker(marker)
+	if err != nil {
+		return nil, err
+	}
+
+	ret, position, err = parseMarkerOr(tokens, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if position < len(tokens) {
+
+		errorMsg := fmt.Sprintf("unexpected '%s' in marker '%s'", tokens[position].text, marker)
+		return nil, errors.New(errorMsg)
+	}
+	return ret, nil
+}
+
+func tokenizeMarker(marker string) ([]markerToken, error) {
+
+	var ret []markerToken
+	var end int
+
+	for index := 0; index < len(marker); {
+
+		character := marker[index]
+
+		switch {
+		case character == ' ' || character == '\t':
+			index++
+
+		case character == '(' || character == ')':
+
+			ret = append(ret, markerToken{kind: character, text: string(character)})
+			index++
+
+		case character == '"' || character == '\'':
+
+			end = strings.IndexByte(marker[index+1:], character)
+			if end < 0 {
+
+				errorMsg := fmt.Sprintf("unterminated string in marker '%s'", marker)
+				return nil, errors.New(errorMsg)
+			}
+
+			ret = append(ret, markerToken{kind: 's', text: marker[index+1 : index+1+end]})
+			index += end + 2
+
+		case strings.ContainsRune("<>=!~", rune(character)):
+
+			end = index
+			for end < len(marker) && strings.ContainsRune("<>=!~", rune(marker[end])) {
+				end++
+			}
+
+			switch marker[index:end] {
+			case "<", "<=", "!=", "==", ">=", ">", "~=", "===":
+			default:
+
+				errorMsg := fmt.Sprintf("unknown operator '%s' in marker '%s'", marker[index:end], marker)
+				return nil, errors.New(errorMsg)
+			}
+
+			ret = append(ret, markerToken{kind: 'o', text: marker[index:end]})
+			index = end
+
+		case isIdentifierCharacter(character) || character == '.':
+
+			end = index
+			for end < len(marker) && (isIdentifierCharacter(marker[end]) || marker[end] == '.') {
+				end++
+			}
+
+			ret = append(ret, markerToken{kind: 'i', text: marker[index:end]})
+			index = end
+
+		default:
+
+			errorMsg := fmt.Sprintf("unexpected '%c' in marker '%s'", character, marker)
+			return nil, errors.New(errorMsg)
+		}
+	}
+	return ret, nil
+}
+
+func parseMarkerOr(tokens []markerToken, position int) (*markerExpression, int, error) {
+	return parseMarkerChain(tokens, position, "or", parseMarkerAnd)
+}
+
+func parseMarkerAnd(tokens []markerToken, position int) (*markerExpression, int, error) {
+	return parseMarkerChain(tokens, position, "and", parseMarkerComparison)
+}
+
+/*
+	Parses one or more markers (each parsed by [parseOperand]) joined by the given [keyword], starting at [position] within [tokens].
+	Returns the marker, and the position just after it.
+*/
+func parseMarkerChain(tokens []markerToken, position int, keyword string, parseOperand func([]markerToken, int) (*markerExpression, int, error)) (*markerExpression, int, error) {
+
+	var ret, operand *markerExpression
+	var err error
+
+	ret = &markerExpression{operator: keyword}
+
+	for {
+		operand, position, err = parseOperand(tokens, position)
+		if err != nil {
+			return nil, position, err
+		}
+		ret.operands = append(ret.operands, operand)
+
+		if position >= len(tokens) || tokens[position].kind != 'i' || tokens[position].text != keyword {
+			break
+		}
+		position++
+	}
+
+	if len(ret.operands) == 1 {
+		return ret.operands[0], position, nil
+	}
+	return ret, position, nil
+}
+
+/*
+	Parses a parenthesized marker, or a single comparison ('python_version >= "3.8"', '"linux" in sys_platform').
+*/
+func parseMarkerComparison(tokens []markerToken, position int) (*markerExpression, int, error) {
+
+	var ret *markerExpression
+	var err error
+
+	if position < len(tokens) && tokens[position].kind == '(' {
+
+		ret, position, err = parseMarkerOr(tokens, position+1)
+		if err != nil {
+			return nil, position, err
+		}
+
+		if position >= len(tokens) || tokens[position].kind != ')' {
+			return nil, position, errors.New("expected ')' in marker")
+		}
+		return ret, position + 1, nil
+	}
+
+	ret = new(markerExpression)
+
+	ret.left, position, err = parseMarkerValue(tokens, position)
+	if err != nil {
+		return nil, position, err
+	}
+
+	switch {
+	case position < len(tokens) && tokens[position].kind == 'o':
+
+		ret.operator = tokens[position].text
+		position++
+
+	case position < len(tokens) && tokens[position].kind == 'i' && tokens[position].text == "in":
+
+		ret.operator = "in"
+		position++
+
+	case position+1 < len(tokens) && tokens[position].text == "not" && tokens[position+1].text == "in":
+
+		ret.operator = "not in"
+		position += 2
+
+	default:
+		return nil, position, errors.New("expected a comparison in marker")
+	}
+
+	ret.right, position, err = parseMarkerValue(tokens, position)
+	if err != nil {
+		return nil, position, err
+	}
+	return ret, position, nil
+}
+
+func parseMarkerValue(tokens []markerToken, position int) (markerValue, int, error) {
+
+	var ret markerValue
+
+	if position >= len(tokens) {
+		return ret, position, errors.New("marker ends too soon")
+	}
+
+	switch tokens[position].kind {
+	case 's':
+		ret.literal = tokens[position].text
+
+	case 'i':
+
+		// the older, dotted names of some variables ('os.name', 'platform.machine') are still accepted.
+		ret.variable = strings.Replace(tokens[position].text, ".", "_", -1)
+		if ret.variable == "python_implementation" {
+			ret.variable = "platform_python_implementation"
+		}
+
+	default:
+
+		errorMsg := fmt.Sprintf("expected a variable or string in marker, not '%s'", tokens[position].text)
+		return ret, position, errors.New(errorMsg)
+	}
+	return ret, position + 1, nil
+}
+
+/*
+	Returns true if this marker holds in the given [environment].
+	Returns an error if the marker refers to a variable the environment doesn't have, or compares values in a way python can't.
+*/
+func (this *markerExpression) evaluate(environment markerEnvironment) (bool, error) {
+
+	var left, right string
+	var result bool
+	var err error
+
+	switch this.operator {
+	case "and", "or":
+
+		for _, operand := range this.operands {
+
+			result, err = operand.evaluate(environment)
+			if err != nil {
+				return false, err
+			}
+
+			if result == (this.operator == "or") {
+				return result, nil
+			}
+		}
+		return this.operator == "and", nil
+	}
+
+	left, err = this.left.resolve(environment)
+	if err != nil {
+		return false, err
+	}
+
+	right, err = this.right.resolve(environment)
+	if err != nil {
+		return false, err
+	}
+
+	switch this.operator {
+	case "in":
+		return strings.Contains(right, left), nil
+	case "not in":
+		return !strings.Contains(right, left), nil
+	case "===":
+		return left == right, nil
+	}
+
+	// comparisons are between versions when both sides are versions (or, on the right, a prefix such as '3.*').
+	_, leftIsVersion := parseVersion(left)
+	_, rightIsVersion := parseVersion(strings.TrimSuffix(right, ".*"))
+
+	if leftIsVersion && rightIsVersion {
+		return satisfiesSpecifiers(left, []versionSpecifier{{operator: this.operator, version: right}}), nil
+	}
+
+	switch this.operator {
+	case "==":
+		return left == right, nil
+	case "!=":
+		return left != right, nil
+	case "<":
+		return left < right, nil
+	case "<=":
+		return left <= right, nil
+	case ">":
+		return left > right, nil
+	case ">=":
+		return left >= right, nil
+	}
+
+	errorMsg := fmt.Sprintf("'%s' can't compare '%s' and '%s', which aren't both versions", this.operator, left, right)
+	return false, errors.New(errorMsg)
+}
+
+/*
+	Returns the value of this marker value in the given [environment].
+	'extra' is always empty, since requirements files don't install extras by marker.
+*/
+func (this markerValue) resolve(environment markerEnvironment) (string, error) {
+
+	if this.variable == "" {
+		return this.literal, nil
+	}
+
+	if this.variable == "extra" {
+		return "", nil
+	}
+
+	value, found := environment[this.variable]
+	if !found {
+
+		errorMsg := fmt.Sprintf("unknown marker variable '%s'", this.variable)
+		return "", errors.New(errorMsg)
+	}
+	return value, nil
+}
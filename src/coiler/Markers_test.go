@@ -0,0 +1,107 @@
+package coiler
+
+import (
+	"testing"
+)
+
+func TestEvaluateMarker(test *testing.T) {
+
+	var environment markerEnvironment
+
+	environment = markerEnvironment{
+		"python_version":                 "3.11",
+		"python_full_version":            "3.11.7",
+		"sys_platform":                   "linux",
+		"platform_system":                "Linux",
+		"platform_machine":               "x86_64",
+		"platform_python_implementation": "CPython",
+		"os_name":                        "posix",
+		"implementation_name":            "cpython",
+		"implementation_version":         "3.11.7",
+	}
+
+	var cases = []struct {
+		marker   string
+		expected bool
+	}{
+		{`python_version < "3.8"`, false},
+		{`python_version >= "3.8"`, true},
+		{`python_version == "3.11"`, true},
+		{`python_version == "3.1"`, false},
+		{`python_version > "3.9"`, true},
+		{`"3.8" < python_version`, true},
+		{`python_full_version >= '3.11.0'`, true},
+		{`python_full_version == "3.11.*"`, true},
+		{`python_full_version < "3.11.7"`, false},
+		{`python_version ~= "3.9"`, true},
+		{`sys_platform == "win32"`, false},
+		{`sys_platform != "win32"`, true},
+		{`platform_system == "Linux" and os_name == "posix"`, true},
+		{`os_name == "nt" or implementation_name == "cpython"`, true},
+		{`os_name == "nt" or implementation_name == "pypy"`, false},
+		{`sys_platform == "linux" and (os_name == "nt" or implementation_name == "cpython")`, true},
+		{`(sys_platform == "linux" and os_name == "nt") or implementation_name == "pypy"`, false},
+		{`"linux" in sys_platform`, true},
+		{`"win" not in sys_platform`, true},
+		{`platform_machine in "x86_64 aarch64"`, true},
+		{`extra == "tests"`, false},
+		{`os.name == "posix"`, true},
+		{`platform.python_implementation == "CPython"`, true},
+		{`python_implementation == "PyPy"`, false},
+		{`platform_python_implementation === "CPython"`, true},
+	}
+
+	for _, testCase := range cases {
+
+		marker, err := parseMarker(testCase.marker)
+		if err != nil {
+			test.Errorf("'%s': unexpected error: %v", testCase.marker, err)
+			continue
+		}
+
+		result, err := marker.evaluate(environment)
+		if err != nil {
+			test.Errorf("'%s': unexpected error: %v", testCase.marker, err)
+			continue
+		}
+
+		if result != testCase.expected {
+			test.Errorf("expected '%s' to be %v", testCase.marker, testCase.expected)
+		}
+	}
+
+	// these parse, but can't be evaluated.
+	for _, invalid := range []string{`unknown_variable == "1"`, `sys_platform ~= "linux"`} {
+
+		marker, err := parseMarker(invalid)
+		if err != nil {
+			test.Errorf("'%s': unexpected error: %v", invalid, err)
+			continue
+		}
+
+		if _, err = marker.evaluate(environment); err == nil {
+			test.Errorf("expected '%s' not to be evaluated", invalid)
+		}
+	}
+}
+
+func TestParseMarkerErrors(test *testing.T) {
+
+	for _, invalid := range []string{
+		``,
+		`python_version`,
+		`python_version <`,
+		`python_version < "3.8`,
+		`python_version => "3.8"`,
+		`(python_version < "3.8"`,
+		`python_version < "3.8")`,
+		`python_version < "3.8" and`,
+		`python_version < "3.8" xor os_name == "nt"`,
+		`python_version not "3.8"`,
+		`python_version < "3.8" ; os_name == "nt"`,
+	} {
+		if _, err := parseMarker(invalid); err == nil {
+			test.Errorf("expected '%s' not to be a valid marker", invalid)
+		}
+	}
+}
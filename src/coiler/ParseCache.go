@@ -0,0 +1,280 @@
+package coiler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// identifies the layout of cached analyses. Must be changed whenever FileAnalysis changes (which its tests check).
+	// Since how analyses are produced can change without it, entries are also kept apart by the build of coiler which made them.
+	CACHE_FORMAT = "10"
+)
+
+// the hash of the running executable, read once.
+var executableHashOnce sync.Once
+var executableHashValue string
+
+/*
+	The result of reading a single source file; everything about it that doesn't depend on the build it is part of.
+*/
+type FileAnalysis struct {
+
+	// the top-level names defined by the file
+	Symbols []SymbolDefinition `json:"symbols"`
+
+	// every import statement in the file, in order
+	Imports []ImportStatement `json:"imports"`
+}
+
+/*
+	A top-level name defined by a source file, and the (1-based) line and column it is defined at.
+*/
+type SymbolDefinition struct {
+	Name   string `json:"name"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+
+	// true if the name is bound by a def or class statement (rather than only by assignment, for instance).
+	Definition bool `json:"definition,omitempty"`
+
+	// for definitions, the last line of each top-level statement which defines the name.
+	// once that line has run, the name refers to the function or class it defined.
+	Ends []int `json:"ends,omitempty"`
+}
+
+/*
+	A single import statement, in one of the forms;
+		import Module
+		import Module as Alias
+		from Module import Name
+		from Module import Name as Alias
+	or a dynamic import;
+		__import__("Module")
+		importlib.import_module("Module")
+*/
+type ImportStatement struct {
+	Module string `json:"module"`
+
+	// for 'from' imports, the name being imported. "*" for wild imports.
+	Name string `json:"name,omitempty"`
+
+	Alias string `json:"alias,omitempty"`
+
+	// true for calls to __import__ or import_module. If the module name isn't a constant string, Module is empty.
+	Dynamic bool `json:"dynamic,omitempty"`
+
+	// true for import statements within an indented block (an 'if', 'try', function, etc), which may or may not run.
+	Guarded bool `json:"guarded,omitempty"`
+
+	// where the statement begins (1-based)
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+/*
+	Holds the analysis of every source file that has been read, keyed by the hash of its contents.
+	Analyses are also kept on disk (if a directory is given), so that unchanged files are not re-analyzed by later runs.
+	Since an analysis only depends on the file's own contents, only files which have changed are ever re-analyzed.
+	Safe for concurrent use, so that several builds can share it.
+*/
+type ParseCache struct {
+	analyses map[string]*FileAnalysis
+	lock     sync.Mutex
+
+	// where analyses are stored on disk. Empty if they are only kept in memory.
+	directory string
+}
+
+/*
+	Creates a cache which stores analyses under the given [directory].
+	If [directory] is empty, analyses are only kept for the lifetime of the cache.
+*/
+func NewParseCache(directory string) *ParseCache {
+
+	var ret *ParseCache
+	var build string
+
+	ret = new(ParseCache)
+	ret.analyses = make(map[string]*FileAnalysis)
+
+	// analyses are only stored on disk if the build of coiler which made them can be told apart from any other.
+	build = executableHash()
+	if directory != "" && build != "" {
+		ret.directory = filepath.Join(directory, VERSION, CACHE_FORMAT, build)
+	}
+	return ret
+}
+
+/*
+	Returns an abbreviated hash of the running executable, or an empty string if it can't be read.
+	Any change to how files are analyzed changes the executable, so no analysis is ever read by a build of coiler other than the one which made it.
+*/
+func executableHash() string {
+
+	executableHashOnce.Do(func() {
+
+		var path string
+		var file *os.File
+		var digest hash.Hash
+		var err error
+
+		path, err = os.Executable()
+		if err != nil {
+			return
+		}
+
+		file, err = os.Open(path)
+		if err != nil {
+			return
+		}
+		defer file.Close()
+
+		digest = sha256.New()
+		_, err = io.Copy(digest, file)
+		if err != nil {
+			return
+		}
+		executableHashValue = hex.EncodeToString(digest.Sum(nil))[0:16]
+	})
+	return executableHashValue
+}
+
+/*
+	Returns the default location of the on-disk cache, or an empty string if the user has no cache directory.
+*/
+func DefaultCacheDirectory() string {
+
+	var directory string
+	var err error
+
+	directory, err = os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(directory, "coiler")
+}
+
+/*
+	Returns the analysis of the source file at the given [path], reading and analyzing it only if its contents haven't been seen before.
+*/
+func (this *ParseCache) Analyze(path string) (*FileAnalysis, error) {
+
+	var analysis *FileAnalysis
+	var contents []byte
+	var hash [sha256.Size]byte
+	var key string
+	var found bool
+	var err error
+
+	contents, err = readSourceFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	hash = sha256.Sum256(contents)
+	key = hex.EncodeToString(hash[:])
+
+	this.lock.Lock()
+	analysis, found = this.analyses[key]
+	this.lock.Unlock()
+
+	if found {
+		return analysis, nil
+	}
+
+	analysis = this.load(key)
+	if analysis == nil {
+
+		analysis = analyzeSource(string(contents))
+		this.store(key, analysis)
+	}
+
+	this.lock.Lock()
+	this.analyses[key] = analysis
+	this.lock.Unlock()
+
+	return analysis, nil
+}
+
+/*
+	Reads the analysis with the given [key] from disk, returning nil if there is none (or it can't be read).
+*/
+func (this *ParseCache) load(key string) *FileAnalysis {
+
+	var ret *FileAnalysis
+	var contents []byte
+	var err error
+
+	if this.directory == "" {
+		return nil
+	}
+
+	contents, err = ioutil.ReadFile(this.entryPath(key))
+	if err != nil {
+		return nil
+	}
+
+	ret = new(FileAnalysis)
+
+	err = json.Unmarshal(contents, ret)
+	if err != nil {
+		return nil
+	}
+	return ret
+}
+
+/*
+	Writes the given [analysis] to disk. The cache is only an optimization, so failures are ignored.
+*/
+func (this *ParseCache) store(key string, analysis *FileAnalysis) {
+
+	var temporary *os.File
+	var contents []byte
+	var path string
+	var err error
+
+	if this.directory == "" {
+		return
+	}
+
+	contents, err = json.Marshal(analysis)
+	if err != nil {
+		return
+	}
+
+	path = this.entryPath(key)
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return
+	}
+
+	// write to a temporary file first, so that concurrent runs never see a partially-written entry.
+	temporary, err = ioutil.TempFile(filepath.Dir(path), key)
+	if err != nil {
+		return
+	}
+
+	_, err = temporary.Write(contents)
+	temporary.Close()
+
+	if err == nil {
+		err = os.Rename(temporary.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(temporary.Name())
+	}
+}
+
+func (this *ParseCache) entryPath(key string) string {
+	return filepath.Join(this.directory, key[0:2], key+".json")
+}
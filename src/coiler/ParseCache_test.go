@@ -0,0 +1,55 @@
+package coiler
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+/*
+	The layout of FileAnalysis as it stood when CACHE_FORMAT was last changed.
+	If this test fails, change CACHE_FORMAT and then update both of these to match.
+*/
+const (
+	expectedCacheFormat = "10"
+	expectedCacheLayout = "FileAnalysis{Symbols symbols []SymbolDefinition{Name name string;Line line int;Column column int;Definition definition,omitempty bool;Ends ends,omitempty []int};Imports imports []ImportStatement{Module module string;Name name,omitempty string;Alias alias,omitempty string;Dynamic dynamic,omitempty bool;Guarded guarded,omitempty bool;Line line int;Column column int}}"
+)
+
+func TestCacheFormatMatchesLayout(test *testing.T) {
+
+	var layout string
+
+	layout = describeLayout(reflect.TypeOf(FileAnalysis{}))
+
+	if layout != expectedCacheLayout && CACHE_FORMAT == expectedCacheFormat {
+		test.Fatalf("FileAnalysis has changed without a change to CACHE_FORMAT. Its layout is now:\n%s", layout)
+	}
+
+	if layout != expectedCacheLayout || CACHE_FORMAT != expectedCacheFormat {
+		test.Fatalf("CACHE_FORMAT has changed; update this test to CACHE_FORMAT '%s' and the layout:\n%s", CACHE_FORMAT, layout)
+	}
+}
+
+/*
+	Describes every field (and its json tag) of the given [kind], recursively, as a single line.
+*/
+func describeLayout(kind reflect.Type) string {
+
+	var fields []string
+	var field reflect.StructField
+
+	switch kind.Kind() {
+	case reflect.Slice:
+		return "[]" + describeLayout(kind.Elem())
+	case reflect.Struct:
+	default:
+		return kind.Name()
+	}
+
+	for i := 0; i < kind.NumField(); i++ {
+		field = kind.Field(i)
+		fields = append(fields, fmt.Sprintf("%s %s %s", field.Name, field.Tag.Get("json"), describeLayout(field.Type)))
+	}
+	return kind.Name() + "{" + strings.Join(fields, ";") + "}"
+}
@@ -2,248 +2,503 @@ package coiler
 
 import (
 	"fmt"
-	"io/ioutil"
 	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 )
 
 // import regexes
-var standardImportRegex *regexp.Regexp
-var aliasedImportRegex *regexp.Regexp
-var singleImportRegex *regexp.Regexp
-var singleAliasedImportRegex *regexp.Regexp
+var importRegex *regexp.Regexp
+var fromImportRegex *regexp.Regexp
 var wildImportRegex *regexp.Regexp
-
-var classRegex *regexp.Regexp
-var functionRegex *regexp.Regexp
-var assignmentRegex *regexp.Regexp
+var topLevelImportRegex *regexp.Regexp
+var importedModuleRegex *regexp.Regexp
+var importedNameRegex *regexp.Regexp
+var dynamicImportRegex *regexp.Regexp
+var constantDynamicImportRegex *regexp.Regexp
 
 func init() {
 
-	standardImportRegex = regexp.MustCompile("import ([a-zA-Z0-9_]+)\\s*$")
-	aliasedImportRegex = regexp.MustCompile("import ([a-zA-Z0-9_]+) as ([a-zA-Z0-9_]+)\\s*$")
-	singleImportRegex = regexp.MustCompile("from ([a-zA-Z0-9_]+) import ([a-zA-Z0-9_]+)\\s*$")
-	singleAliasedImportRegex = regexp.MustCompile("from ([a-zA-Z0-9_]+) import ([a-zA-Z0-9_]+) as ([a-zA-Z0-9_]+)\\s*$")
-	wildImportRegex = regexp.MustCompile("from ([a-zA-Z0-9_]+) import \\*\\s*$")
-
-	classRegex = regexp.MustCompile("class ([a-zA-Z0-9_]+).*:")
-	functionRegex = regexp.MustCompile("def ([a-zA-Z0-9_]+)\\(.*\\):")
-	assignmentRegex = regexp.MustCompile("([a-zA-Z0-9_]+)\\s+=")
+	importRegex = regexp.MustCompile("\\bimport\\s+([^()]+?)\\s*$")
+	fromImportRegex = regexp.MustCompile("\\bfrom\\s+([a-zA-Z0-9_.]+)\\s+import\\s+(?:\\(\\s*([^()]+?)\\s*\\)|([^()]+?))\\s*$")
+	topLevelImportRegex = regexp.MustCompile("^(?:import|from)\\s")
+	wildImportRegex = regexp.MustCompile("\\bfrom\\s+([a-zA-Z0-9_.]+)\\s+import\\s+\\*\\s*$")
+	importedModuleRegex = regexp.MustCompile("^([a-zA-Z_][a-zA-Z0-9_]*(?:\\s*\\.\\s*[a-zA-Z_][a-zA-Z0-9_]*)*)(?:\\s+as\\s+([a-zA-Z_][a-zA-Z0-9_]*))?$")
+	importedNameRegex = regexp.MustCompile("^([a-zA-Z_][a-zA-Z0-9_]*)(?:\\s+as\\s+([a-zA-Z_][a-zA-Z0-9_]*))?$")
+	dynamicImportRegex = regexp.MustCompile("\\b(__import__|import_module)\\s*\\(")
+	constantDynamicImportRegex = regexp.MustCompile("^(?:__import__|import_module)\\s*\\(\\s*(?:'([a-zA-Z0-9_.]+)'|\"([a-zA-Z0-9_.]+)\")\\s*[,)]")
 }
 
 /*
 	Parses the given [inputPath], traverses and processes all dependent imports (combining as required),
-	and uses python to compile a real executable to the given [outputPath].
+	and returns a context which can be used to compile a combined output.
 */
-func Parse(inputPath string, useSystemPaths bool) (*BuildContext, error) {
+func Parse(inputPath string, options BuildOptions) (*BuildContext, error) {
 
-	var context *BuildContext
+	var session *BuildSession
 	var err error
 
-	context = NewBuildContext(useSystemPaths)
-
-	// combine in context
-	_, err = parse(inputPath, context)
+	session, err = NewBuildSession(options)
 	if err != nil {
 		return nil, err
 	}
+	return session.Parse(inputPath)
+}
 
-	return context, nil
+/*
+	A source file which has been read and analyzed, but whose imports haven't been linked yet.
+*/
+type parsedFile struct {
+	context  *FileContext
+	analysis *FileAnalysis
+}
+
+/*
+	An import statement which names a combined module, and the file it was found in.
+*/
+type importSite struct {
+	statement ImportStatement
+	importer  *parsedFile
 }
 
-func parse(path string, context *BuildContext) (*FileContext, error) {
+/*
+	Parses the file at the given [path] and every combined module it imports, then links them all together into the given [context].
+*/
+func parse(path string, context *BuildContext) error {
 
-	var fileContext *FileContext
-	var contents []byte
-	var sourceChannel chan string
+	var files map[string]*parsedFile
+	var entry *parsedFile
 	var err error
 
-	sourceChannel = make(chan string)
+	files, entry, err = readImportTree(path, context)
+	if err != nil {
+		return err
+	}
+
+	linkFile(entry, files, context, make(map[*FileContext]bool))
+	return context.resolveSymbols()
+}
+
+/*
+	Reads and analyzes the file at the given [path], and every combined module it (transitively) imports, using a pool of workers.
+	Returns each file keyed by module name, as well as the entry file itself.
+*/
+func readImportTree(path string, context *BuildContext) (map[string]*parsedFile, *parsedFile, error) {
+
+	var files map[string]*parsedFile
+	var entry *parsedFile
+	var jobs chan importSite
+	var pending sync.WaitGroup
+	var lock sync.Mutex
+	var queueImports func(file *parsedFile)
+	var err error
 
-	contents, err = ioutil.ReadFile(path)
+	entry, err = readFile(path, context)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	// the entry point claims its own module name, so that anything which imports it (circularly) is linked back to it.
+	// unless that name belongs to some other file, in which case the two will collide.
+	files = make(map[string]*parsedFile)
+
+	if context.FindSourcePath(entry.context.namespace) == entry.context.fullPath {
+		files[entry.context.namespace] = entry
+		context.ClaimImportedFile(entry.context.namespace)
+	}
+
+	jobs = make(chan importSite)
+
+	queueImports = func(file *parsedFile) {
+
+		for _, statement := range file.analysis.Imports {
+
+			if statement.Name == "*" || statement.Module == "" || statement.Guarded || context.FindSourcePath(statement.Module) == "" {
+				continue
+			}
+
+			if !context.ClaimImportedFile(statement.Module) {
+				continue
+			}
+
+			pending.Add(1)
+			go func(site importSite) {
+				jobs <- site
+			}(importSite{statement: statement, importer: file})
+		}
 	}
 
-	fileContext, err = NewFileContext(path, context)
+	for i := 0; i < runtime.NumCPU(); i++ {
+
+		go func() {
+			for site := range jobs {
+
+				file, err := readFile(context.FindSourcePath(site.statement.Module), context)
+				if err != nil {
+
+					message := fmt.Sprintf("Unable to read module '%s': %v", site.statement.Module, err)
+					context.AddDiagnostic(newDiagnostic(SEVERITY_ERROR, DIAGNOSTIC_UNREADABLE_MODULE, site.importer.context.fullPath, site.statement.Line, site.statement.Column, message))
+				} else {
+
+					lock.Lock()
+					files[site.statement.Module] = file
+					lock.Unlock()
+
+					queueImports(file)
+				}
+				pending.Done()
+			}
+		}()
+	}
+
+	queueImports(entry)
+	pending.Wait()
+	close(jobs)
+
+	return files, entry, nil
+}
+
+/*
+	Reads and analyzes a single file, adding its top-level symbols to the given [context].
+*/
+func readFile(path string, context *BuildContext) (*parsedFile, error) {
+
+	var ret *parsedFile
+	var err error
+
+	ret = new(parsedFile)
+
+	ret.analysis, err = context.session.cache.Analyze(path)
 	if err != nil {
 		return nil, err
 	}
 
-	context.AddDependency(fileContext)
-	go readLines(string(contents), sourceChannel)
-
-	for line := range sourceChannel {
+	ret.context, err = NewFileContext(path, context)
+	if err != nil {
+		return nil, err
+	}
 
-		err = parseLine(line, fileContext, context)
-		if err != nil {
-			return nil, err
+	// files other than the entry point have module attributes of their own, which the translator binds before anything else.
+	if ret.context.fullPath != context.entryPoint {
+		for _, name := range moduleAttributeNames {
+			addSymbolToContexts(SymbolDefinition{Name: name}, ret.context, context)
 		}
 	}
 
-	return fileContext, nil
+	for _, symbol := range ret.analysis.Symbols {
+		addSymbolToContexts(symbol, ret.context, context)
+	}
+	return ret, nil
 }
 
-func readLines(source string, output chan string) {
+/*
+	Links the imports of the given [file] in the order they appear, following (depth-first) any combined modules it imports.
+	Since this happens in source order, the dependency graph and external dependencies come out the same
+	regardless of the order in which files were read.
+*/
+func linkFile(file *parsedFile, files map[string]*parsedFile, context *BuildContext, linked map[*FileContext]bool) {
 
-	var newlineIndex int
+	linked[file.context] = true
+	context.AddDependency(file.context)
 
-	defer close(output)
+	for _, statement := range file.analysis.Imports {
+		parseImport(statement, file, files, context, linked)
+	}
+}
 
-	newlineIndex = -1
+/*
+	Reads the given python [source], finding every top-level symbol and import statement.
+*/
+func analyzeSource(source string) *FileAnalysis {
 
-	for newlineIndex != len(source) {
+	var ret *FileAnalysis
+	var physicalLines []string
 
-		source = source[newlineIndex+1:]
-		newlineIndex = strings.Index(source, "\n")
+	ret = new(FileAnalysis)
+	physicalLines = strings.Split(source, "\n")
 
-		if newlineIndex < 0 {
-			newlineIndex = len(source)
-		}
+	// imports are read from logical lines, so that those which continue over several lines are read whole,
+	// and those which are actually within a string or comment aren't read at all.
+	for _, line := range readLogicalLines(source) {
+
+		analyzeLine(line, ret)
 
-		output <- string(source[0:newlineIndex])
+		// dynamic imports may happen anywhere, not just at the top level.
+		if strings.Contains(line.text, "import") {
+			analyzeDynamicImports(line, physicalLines, ret)
+		}
 	}
+
+	ret.Symbols = findBindings(source)
+
+	return ret
 }
 
-func parseLine(line string, fileContext *FileContext, buildContext *BuildContext) error {
+func analyzeLine(line logicalLine, analysis *FileAnalysis) {
 
-	var symbol []string
+	var statements []ImportStatement
 	var trimmedLine string
 
-	trimmedLine = strings.Trim(line, " \t\r\n")
-
 	// any import
-	if strings.Contains(line, "import") {
-		parseImport(trimmedLine, fileContext, buildContext)
-	}
+	if strings.Contains(line.text, "import") {
 
-	// if this line is indented, ignore it. We only need to translate top-level stuff.
-	if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
-		return nil
-	}
+		trimmedLine = strings.Join(strings.Fields(line.text), " ")
 
-	// classes
-	if strings.Contains(line, "class") {
+		statements = analyzeImport(trimmedLine)
+		for _, statement := range statements {
 
-		symbol = classRegex.FindStringSubmatch(line)
-		if len(symbol) > 0 {
-			addSymbolToContexts(symbol[1], fileContext, buildContext)
+			statement.Line = line.line
+			statement.Column = line.indent + 1
+
+			// imports which are indented, or which follow something else on the same line ('if x: import y'), are left in place by TranslateLine.
+			statement.Guarded = statement.Column > 1 || !topLevelImportRegex.MatchString(trimmedLine)
+			analysis.Imports = append(analysis.Imports, statement)
 		}
 	}
+}
 
-	// function
-	if strings.Contains(line, "def") {
+/*
+	Finds every call to __import__ or import_module in the given logical [line], one of those of a file with the given [physicalLines].
+	Calls are found in the masked line, so that those within strings and comments are left out. Masking keeps every character in place,
+	so a call's module name (which is a string, and so masked) is read from the same place in the source.
+	Calls with a constant module name are treated like any other import. Others are recorded with no module name, so they can be reported.
+*/
+func analyzeDynamicImports(line logicalLine, physicalLines []string, analysis *FileAnalysis) {
 
-		symbol = functionRegex.FindStringSubmatch(line)
-		if len(symbol) > 0 {
-			addSymbolToContexts(symbol[1], fileContext, buildContext)
-		}
+	var source string
+	var constant []string
+	var statement ImportStatement
+	var last, lineStart int
+
+	last = line.line + strings.Count(line.text, "\n")
+	if last > len(physicalLines) {
+		last = len(physicalLines)
 	}
+	source = strings.Join(physicalLines[line.line-1:last], "\n")
 
-	// namespace-level variable
-	if strings.Contains(line, "=") {
+	for _, call := range dynamicImportRegex.FindAllStringIndex(line.text, -1) {
 
-		symbol = assignmentRegex.FindStringSubmatch(line)
-		if len(symbol) > 0 {
-			addSymbolToContexts(symbol[1], fileContext, buildContext)
+		lineStart = strings.LastIndex(line.text[:call[0]], "\n") + 1
+		statement = ImportStatement{
+			Dynamic: true,
+			Line:    line.line + strings.Count(line.text[:call[0]], "\n"),
+			Column:  call[0] - lineStart + 1,
 		}
-	}
 
-	return nil
+		if call[0] < len(source) {
+
+			constant = constantDynamicImportRegex.FindStringSubmatch(source[call[0]:])
+			if len(constant) > 0 {
+				statement.Module = constant[1] + constant[2]
+			}
+		}
+
+		analysis.Imports = append(analysis.Imports, statement)
+	}
 }
 
 /*
-	Parses a single 'import' statement as it occurs in a source file.
-	Modifies the file and build contexts as appropriate.
+	Determines which form of 'import' statement the given [line] (without strings or comments) is, if any.
+	Returns one statement for each module (or name) imported, in order. Module names have any whitespace removed.
 */
-func parseImport(line string, fileContext *FileContext, buildContext *BuildContext) {
+func analyzeImport(line string) []ImportStatement {
 
-	var dependentContext *FileContext
-	var matches []string
+	var ret []ImportStatement
+	var matches, parts []string
+	var module, names string
 
 	// imports can happen in any number of wacky forms
-	// go through from most-to-least specific and try to determine which form is being used,
-	// and how to modify the contexts
+	// go through from most-to-least specific and try to determine which form is being used.
 	matches = wildImportRegex.FindStringSubmatch(line)
 	if len(matches) > 0 {
-		fmt.Println("Wild import statement detected. Ignoring.")
-		return
+
+		if isRelativeImport(matches[1]) {
+			return nil
+		}
+		return []ImportStatement{ImportStatement{Module: matches[1], Name: "*"}}
 	}
 
-	matches = singleAliasedImportRegex.FindStringSubmatch(line)
+	matches = fromImportRegex.FindStringSubmatch(line)
 	if len(matches) > 0 {
 
-		dependentContext = parseAndImport(matches[1], fileContext, buildContext)
-		if dependentContext == nil {
-			return
+		module = matches[1]
+		if isRelativeImport(module) {
+			return nil
 		}
 
-		fileContext.AliasCall(dependentContext, matches[2], matches[3])
-		return
+		names = matches[2] + matches[3]
+
+		for _, name := range splitImportList(names) {
+
+			parts = importedNameRegex.FindStringSubmatch(name)
+			if len(parts) == 0 {
+				return nil
+			}
+			ret = append(ret, ImportStatement{Module: module, Name: parts[1], Alias: parts[2]})
+		}
+		return ret
 	}
 
-	matches = singleImportRegex.FindStringSubmatch(line)
+	matches = importRegex.FindStringSubmatch(line)
 	if len(matches) > 0 {
 
-		dependentContext = parseAndImport(matches[1], fileContext, buildContext)
-		if dependentContext == nil {
-			return
+		for _, name := range splitImportList(matches[1]) {
+
+			parts = importedModuleRegex.FindStringSubmatch(name)
+			if len(parts) == 0 {
+				return nil
+			}
+
+			module = strings.Join(strings.Fields(parts[1]), "")
+			ret = append(ret, ImportStatement{Module: module, Alias: parts[2]})
 		}
+		return ret
+	}
+
+	return nil
+}
+
+/*
+	Returns true if the given [module] (as named by a 'from' import) is relative to the importing package, which is never combined.
+*/
+func isRelativeImport(module string) bool {
+	return strings.HasPrefix(module, ".") || strings.HasSuffix(module, ".") || strings.Contains(module, "..")
+}
+
+/*
+	Splits the comma-separated list of [names] given to an import statement, ignoring a trailing comma.
+*/
+func splitImportList(names string) []string {
+
+	var ret []string
+
+	names = strings.TrimSuffix(strings.TrimSpace(names), ",")
+
+	for _, name := range strings.Split(names, ",") {
+		ret = append(ret, strings.TrimSpace(name))
+	}
+	return ret
+}
+
+/*
+	Processes a single 'import' statement as it occurs in a source file.
+	Modifies the file and build contexts as appropriate.
+*/
+func parseImport(statement ImportStatement, file *parsedFile, files map[string]*parsedFile, buildContext *BuildContext, linked map[*FileContext]bool) {
+
+	var dependency *parsedFile
+	var fileContext, dependentContext *FileContext
+	var found bool
+
+	fileContext = file.context
 
-		fileContext.UnaliasedCall(dependentContext, matches[2])
+	// packages can't be combined, but a wheel's are only found by the build, not at runtime.
+	if buildContext.reportWheelPackage(statement, fileContext) {
 		return
 	}
 
-	matches = aliasedImportRegex.FindStringSubmatch(line)
-	if len(matches) > 0 {
+	// guarded imports are left in place, to be resolved at runtime. Combining them would mean they always happen (or fail) at startup.
+	if statement.Guarded {
+
+		if buildContext.FindSourcePath(statement.Module) != "" {
 
-		dependentContext = parseAndImport(matches[1], fileContext, buildContext)
-		if dependentContext == nil {
-			return
+			message := fmt.Sprintf("'%s' isn't imported at the top level, so it's left as a runtime import rather than combined. It must be importable at runtime", statement.Module)
+			buildContext.AddDiagnostic(newDiagnostic(SEVERITY_WARNING, DIAGNOSTIC_GUARDED_IMPORT, fileContext.fullPath, statement.Line, statement.Column, message))
 		}
+		return
+	}
 
-		fileContext.AliasContext(dependentContext, matches[2])
+	if statement.Dynamic && statement.Module == "" {
+
+		message := "Dynamic import of a module name which isn't a constant string can't be combined. The module must be importable at runtime"
+		buildContext.AddDiagnostic(newDiagnostic(SEVERITY_WARNING, DIAGNOSTIC_DYNAMIC_IMPORT, fileContext.fullPath, statement.Line, statement.Column, message))
 		return
 	}
 
-	matches = standardImportRegex.FindStringSubmatch(line)
-	if len(matches) > 0 {
+	// future statements only apply to the file they're in, and must come first. The translator deals with the one that matters.
+	if statement.Module == "__future__" {
+		return
+	}
+
+	dependency, found = files[statement.Module]
+	if !found {
 
-		parseAndImport(matches[1], fileContext, buildContext)
+		// dynamic imports of external modules are left to happen at runtime, since they're often optional.
+		if !statement.Dynamic && buildContext.FindSourcePath(statement.Module) == "" {
+
+			buildContext.AddExternalDependency(statement.Module)
+			addExternalImport(statement, fileContext, buildContext)
+		}
 		return
 	}
-}
 
-func parseAndImport(module string, fileContext *FileContext, buildContext *BuildContext) *FileContext {
+	if statement.Name == "*" {
 
-	var dependentContext *FileContext
-	var fullPath string
+		message := fmt.Sprintf("Wild import from '%s' can't be combined, and is ignored", statement.Module)
+		buildContext.AddDiagnostic(newDiagnostic(SEVERITY_WARNING, DIAGNOSTIC_WILD_IMPORT, fileContext.fullPath, statement.Line, statement.Column, message))
+		return
+	}
 
-	if !buildContext.IsFileImported(module) {
+	dependentContext = dependency.context
+	fileContext.AddDependency(statement.Module)
 
-		fullPath = buildContext.FindSourcePath(module)
-		if fullPath != "" {
+	if !linked[dependentContext] {
 
-			buildContext.AddImportedFile(module)
-			dependentContext, _ = parse(fullPath, buildContext)
-			fileContext.AddDependency(module)
-		} else {
-			buildContext.AddExternalDependency(module)
-		}
-	} else {
-		dependentContext = buildContext.GetFileContext(module)
+		buildContext.reportShadowing(statement, fileContext)
+		linkFile(dependency, files, buildContext, linked)
+	}
+
+	if statement.Dynamic {
+		buildContext.AddDynamicModule(statement.Module)
+		return
 	}
 
-	return dependentContext
+	switch {
+	case statement.Name != "" && statement.Alias != "":
+		fileContext.AliasCall(dependentContext, statement.Name, statement.Alias)
+		fileContext.AddImportStatement(statement.Alias, statement)
+	case statement.Name != "":
+		fileContext.UnaliasedCall(dependentContext, statement.Name)
+		fileContext.AddImportStatement(statement.Name, statement)
+	case statement.Alias != "":
+		fileContext.AliasContext(dependentContext, statement.Alias)
+	default:
+		fileContext.AliasContext(dependentContext, statement.Module)
+	}
+}
+
+/*
+	Records a top-level import of an external module, which is written in place of the original import.
+	The name it binds is translated like any other top-level symbol of the file, so that files importing the same name from
+	different modules don't clash. The exception is a plain 'import module', whose binding can't be renamed without changing what it binds.
+*/
+func addExternalImport(statement ImportStatement, fileContext *FileContext, buildContext *BuildContext) {
+
+	var name string
+
+	name = statement.Alias
+	if name == "" && statement.Name != "*" {
+		name = statement.Name
+	}
+
+	if name != "" {
+		addSymbolToContexts(SymbolDefinition{Name: name, Line: statement.Line, Column: statement.Column}, fileContext, buildContext)
+	}
+	fileContext.AddExternalImport(statement)
 }
 
 /*
 	Properly adds the given [symbol] to the given file and build contexts.
 */
-func addSymbolToContexts(symbol string, fileContext *FileContext, buildContext *BuildContext) {
+func addSymbolToContexts(symbol SymbolDefinition, fileContext *FileContext, buildContext *BuildContext) {
 
 	var qualifiedName string
 
-	qualifiedName = fileContext.AddLocalSymbol(symbol)
-	buildContext.AddSymbol(qualifiedName)
+	qualifiedName = fileContext.AddLocalSymbol(symbol.Name)
+	buildContext.AddSymbol(qualifiedName, fileContext, symbol.Line, symbol.Column)
+
+	for _, end := range symbol.Ends {
+		fileContext.AddDefinition(symbol.Name, end)
+	}
 }
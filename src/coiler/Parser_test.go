@@ -0,0 +1,45 @@
+package coiler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAnalyzeDynamicImports(test *testing.T) {
+
+	var source string
+	var dynamic, expected []ImportStatement
+
+	source = `# the old code did __import__('commented') here
+"""
+docstring = __import__('documented')
+"""
+text = "importlib.import_module('quoted')"
+first = __import__('first')
+second = importlib.import_module("pkg.second", package=None)  # __import__('trailing')
+third = load(
+    'x', __import__(
+        'third'))
+unknown = __import__(name)
+if True: both = (__import__('a'), __import__('b'))
+`
+
+	for _, statement := range analyzeSource(source).Imports {
+		if statement.Dynamic {
+			dynamic = append(dynamic, statement)
+		}
+	}
+
+	expected = []ImportStatement{
+		{Module: "first", Dynamic: true, Line: 6, Column: 9},
+		{Module: "pkg.second", Dynamic: true, Line: 7, Column: 20},
+		{Module: "third", Dynamic: true, Line: 9, Column: 10},
+		{Module: "", Dynamic: true, Line: 11, Column: 11},
+		{Module: "a", Dynamic: true, Line: 12, Column: 18},
+		{Module: "b", Dynamic: true, Line: 12, Column: 35},
+	}
+
+	if !reflect.DeepEqual(dynamic, expected) {
+		test.Errorf("expected dynamic imports %+v, got %+v", expected, dynamic)
+	}
+}
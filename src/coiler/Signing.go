@@ -0,0 +1,154 @@
+package coiler
+
+/*
+	Handles signing and verification of native executables.
+	Signatures are Ed25519, and cover every byte of the executable up to the signature itself (which is the last part of the footer).
+*/
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+/*
+	Reads a PEM-encoded (PKCS #8) Ed25519 private key from the given [path],
+	such as one made by "openssl genpkey -algorithm ed25519".
+*/
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+
+	var block *pem.Block
+	var parsed interface{}
+	var key ed25519.PrivateKey
+	var ok bool
+	var err error
+
+	block, err = readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok = parsed.(ed25519.PrivateKey)
+	if !ok {
+		errorMsg := fmt.Sprintf("Signing key '%s' is not an Ed25519 key", path)
+		return nil, errors.New(errorMsg)
+	}
+	return key, nil
+}
+
+/*
+	Reads a PEM-encoded (PKIX) Ed25519 public key from the given [path],
+	such as one made by "openssl pkey -pubout".
+*/
+func LoadVerificationKey(path string) (ed25519.PublicKey, error) {
+
+	var block *pem.Block
+	var parsed interface{}
+	var key ed25519.PublicKey
+	var ok bool
+	var err error
+
+	block, err = readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok = parsed.(ed25519.PublicKey)
+	if !ok {
+		errorMsg := fmt.Sprintf("Verification key '%s' is not an Ed25519 key", path)
+		return nil, errors.New(errorMsg)
+	}
+	return key, nil
+}
+
+/*
+	Checks that the native executable at the given [path] was signed by the private half of the given [key].
+	Returns nil if the signature is valid.
+*/
+func VerifyBinary(path string, key ed25519.PublicKey) error {
+
+	var footer *PayloadFooter
+	var contents []byte
+	var err error
+
+	contents, err = ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	footer, err = readPayloadFooter(contents)
+	if err != nil {
+		return err
+	}
+
+	if !footer.IsSigned() {
+		return errors.New("Binary is not signed")
+	}
+
+	if !ed25519.Verify(key, contents[:len(contents)-SIGNATURE_SIZE], footer.Signature) {
+		return errors.New("Signature does not match, the binary has been modified or was signed with a different key")
+	}
+	return nil
+}
+
+/*
+	Signs the current contents of the file at the given [path].
+*/
+func signFile(path string, key ed25519.PrivateKey) ([]byte, error) {
+
+	var contents []byte
+	var err error
+
+	contents, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ed25519.Sign(key, contents), nil
+}
+
+/*
+	Returns bootstrap source which enables signature verification against the given [key].
+*/
+func verificationPrelude(key ed25519.PublicKey) string {
+
+	var encoded []string
+
+	for _, value := range key {
+		encoded = append(encoded, fmt.Sprintf("0x%02x", value))
+	}
+
+	return fmt.Sprintf("#define COILER_VERIFY\nstatic const unsigned char COILER_PUBLIC_KEY[] = {%s};\n", strings.Join(encoded, ", "))
+}
+
+func readPEM(path string) (*pem.Block, error) {
+
+	var contents []byte
+	var block *pem.Block
+	var err error
+
+	contents, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ = pem.Decode(contents)
+	if block == nil {
+		errorMsg := fmt.Sprintf("Key file '%s' does not contain PEM data", path)
+		return nil, errors.New(errorMsg)
+	}
+	return block, nil
+}
@@ -2,6 +2,8 @@ package coiler
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -9,9 +11,28 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"unicode/utf8"
 )
 
+// matches the start of an 'if __name__ == "__main__":' block, at the top level of a file.
+var mainBlockRegex *regexp.Regexp
+
+// matches 'else' or 'elif' at the top level of a file.
+var elseRegex *regexp.Regexp
+
+// the module attributes which combined files (other than the entry point) see as constants of their own.
+var moduleAttributeNames []string
+
+func init() {
+
+	mainBlockRegex = regexp.MustCompile("^if\\s*\\(?\\s*(__name__\\s*==\\s*['\"]__main__['\"]|['\"]__main__['\"]\\s*==\\s*__name__)\\s*\\)?\\s*:")
+	elseRegex = regexp.MustCompile("^(else\\s*:|elif\\b)")
+	moduleAttributeNames = []string{"__name__", "__file__", "__package__"}
+}
+
 func CompileCombinedFile(outputPath string, context *BuildContext) error {
 
 	var precompiledOutputPath string
@@ -25,20 +46,15 @@ func CompileCombinedFile(outputPath string, context *BuildContext) error {
 
 	baseName = filepath.Base(outputPath)
 	baseName = strings.TrimSuffix(baseName, filepath.Ext(baseName))
-	precompiledName = fmt.Sprintf("%s/%s.py", precompiledOutputPath, baseName)
-
-	if strings.HasSuffix(baseName, ".pyc") {
-		compiledName = fmt.Sprintf("%s/%s", precompiledOutputPath, baseName)
-	} else {
-		compiledName = fmt.Sprintf("%s/%s.pyc", precompiledOutputPath, baseName)
-	}
+	precompiledName = filepath.Join(precompiledOutputPath, baseName+".py")
+	compiledName = filepath.Join(precompiledOutputPath, baseName+".pyc")
 
 	err = writeCombinedOutput(precompiledName, context)
 	if err != nil {
 		return err
 	}
 
-	err = callPythonCompiler(precompiledOutputPath)
+	err = callPythonCompiler(context.options.Interpreter, precompiledName, compiledName)
 	if err != nil {
 		return err
 	}
@@ -47,18 +63,90 @@ func CompileCombinedFile(outputPath string, context *BuildContext) error {
 	return err
 }
 
-func callPythonCompiler(targetPath string) error {
+const (
+	// compiles argv[1] to argv[2], reporting only the compile error (rather than a traceback through py_compile) on failure.
+	COMPILE_SCRIPT = `
+import py_compile, sys
+try:
+	py_compile.compile(sys.argv[1], cfile=sys.argv[2], doraise=True)
+except py_compile.PyCompileError as exception:
+	sys.exit(exception.msg)
+`
+)
+
+const (
+	// defines how combined modules which are imported dynamically are registered in sys.modules.
+	// registered modules look up their (translated) symbols only when accessed, so that they always see the current value.
+	MODULE_REGISTRY_SOURCE = `import sys as __coiler_sys__, types as __coiler_types__
+class __coiler_module__(__coiler_types__.ModuleType):
+	def __getattr__(self, name):
+		try:
+			return globals()[self.__dict__['__coiler_symbols__'][name]]
+		except KeyError:
+			raise AttributeError(name)
+def __coiler_register_module__(name, symbols):
+	module = __coiler_module__(name)
+	module.__coiler_symbols__ = symbols
+	__coiler_sys__.modules[name] = module
+`
+)
+
+const (
+	// restores the runtime names of combined functions and classes (and of anything defined within a class), which otherwise carry their translated names.
+	// since classes then name their module, things which evaluate annotations in a class's module (such as typing.get_type_hints) look there for
+	// the translated names they refer to, so registered modules are given the combined namespace too.
+	// the entry point runs as __main__, whose symbols are found through a module-level __getattr__.
+	NAME_RESTORATION_SOURCE = `def __coiler_restore_names__(module, symbols):
+	for name, mangled in symbols.items():
+		pending = [globals().get(mangled)]
+		seen = set()
+		while pending:
+			value = pending.pop()
+			if value is None or id(value) in seen:
+				continue
+			seen.add(id(value))
+			qualname = getattr(value, '__qualname__', getattr(value, '__name__', None))
+			renamed = isinstance(qualname, str) and (qualname == mangled or qualname.startswith(mangled + '.'))
+			if renamed:
+				try:
+					if qualname == mangled:
+						value.__name__ = name
+					value.__qualname__ = name + qualname[len(mangled):]
+					value.__module__ = module
+				except (AttributeError, TypeError):
+					pass
+				if isinstance(value, type):
+					pending.extend(list(vars(value).values()))
+			if renamed or isinstance(value, (staticmethod, classmethod, property)):
+				pending.extend([getattr(value, attribute, None) for attribute in ('__wrapped__', '__func__', 'fget', 'fset', 'fdel')])
+def __coiler_share_globals__(module):
+	namespace = __coiler_sys__.modules[module].__dict__
+	for key, value in list(globals().items()):
+		if not key.startswith('__') and key not in namespace:
+			namespace[key] = value
+def __getattr__(name):
+	try:
+		return globals()[__coiler_main_symbols__[name]]
+	except (KeyError, NameError):
+		raise AttributeError(name)
+`
+)
+
+/*
+	Compiles the python source at [sourcePath] to bytecode at [targetPath].
+	py_compile is given the target explicitly, since python 3 would otherwise write into a __pycache__ directory.
+*/
+func callPythonCompiler(interpreter string, sourcePath string, targetPath string) error {
 
 	var compiler *exec.Cmd
 	var arguments []string
 	var output []byte
 	var err error
 
-	arguments = []string{"-m", "compileall", targetPath}
+	arguments = []string{"-c", COMPILE_SCRIPT, sourcePath, targetPath}
 
-	compiler = exec.Command("python", arguments...)
+	compiler = exec.Command(interpreter, arguments...)
 
-	fmt.Println("Calling python compiler")
 	output, err = compiler.CombinedOutput()
 
 	if err != nil {
@@ -99,8 +187,10 @@ func copyFile(source, target string) error {
 func writeCombinedOutput(targetPath string, buildContext *BuildContext) error {
 
 	var fileContexts []*FileContext
+	var manifest *BuildManifest
 	var outFile *os.File
 	var line string
+	var preserveNames, isEntryPoint bool
 	var err error
 
 	outFile, err = os.Create(targetPath)
@@ -113,53 +203,380 @@ func writeCombinedOutput(targetPath string, buildContext *BuildContext) error {
 	}
 	defer outFile.Close()
 
-	// write external dependencies first
-	for _, dependency := range buildContext.externalDependencies {
+	fileContexts = buildContext.GetCombinedFiles()
 
-		line = fmt.Sprintf("import %v\n", dependency)
-		outFile.Write([]byte(line))
+	manifest, err = NewBuildManifest(buildContext, fileContexts)
+	if err != nil {
+		return err
 	}
 
-	buildContext.dependencies.DiscoverNeighbors()
-	fileContexts = buildContext.dependencies.GetOrderedNodes()
+	line, err = manifest.SourceLine()
+	if err != nil {
+		return err
+	}
+	outFile.Write([]byte(line))
+
+	err = writeDataFiles(buildContext.options.DataFiles, outFile)
+	if err != nil {
+		return err
+	}
+
+	preserveNames = buildContext.options.PreserveNames
+
+	if len(buildContext.dynamicModules) > 0 || preserveNames {
+		outFile.Write([]byte(MODULE_REGISTRY_SOURCE))
+	}
+
+	if preserveNames {
+		outFile.Write([]byte(NAME_RESTORATION_SOURCE))
+	}
 
 	for _, context := range fileContexts {
 
+		isEntryPoint = context.fullPath == buildContext.entryPoint
+
+		// the entry point is already in sys.modules as __main__, its symbols are found through __getattr__ as soon as it starts running.
+		if preserveNames && isEntryPoint {
+			outFile.Write([]byte(fmt.Sprintf("__coiler_main_symbols__ = {%s}\n", strings.Join(translatedSymbols(context), ", "))))
+		}
+
 		err = writeTranslatedFile(context, outFile)
 		if err != nil {
 			return err
 		}
+
+		if buildContext.IsDynamicModule(context.namespace) || (preserveNames && !isEntryPoint) {
+			writeModuleRegistration(context, outFile)
+		}
+
+		if preserveNames && !isEntryPoint {
+			outFile.Write([]byte(fmt.Sprintf("__coiler_share_globals__(%s)\n", pythonString(context.namespace))))
+		}
 	}
 	return nil
 }
 
+/*
+	Restores the original names of the given functions and classes, just defined by the given combined file.
+*/
+func writeNameRestoration(context *FileContext, names []string, outFile *os.File) {
+
+	var symbols []string
+	var module string
+
+	module = context.namespace
+	if context.fullPath == context.context.entryPoint {
+		module = "__main__"
+	}
+
+	for _, name := range names {
+		symbols = append(symbols, fmt.Sprintf("%s: %s", pythonString(name), pythonString(context.context.TranslateSymbol(context.localSymbols[name]))))
+	}
+
+	outFile.Write([]byte(fmt.Sprintf("__coiler_restore_names__(%s, {%s})\n", pythonString(module), strings.Join(symbols, ", "))))
+}
+
+/*
+	Writes the given top-level import [statement] of an external module, binding the name it would have bound as translated for the given [context].
+*/
+func writeExternalImport(context *FileContext, statement ImportStatement, outFile *os.File) {
+
+	var line, local string
+
+	local = statement.Alias
+	if local == "" {
+		local = statement.Name
+	}
+
+	switch {
+	case statement.Name == "*":
+		line = fmt.Sprintf("from %s import *\n", statement.Module)
+	case statement.Name != "":
+		line = fmt.Sprintf("from %s import %s as %s\n", statement.Module, statement.Name, context.context.TranslateSymbol(context.localSymbols[local]))
+	case statement.Alias != "":
+		line = fmt.Sprintf("import %s as %s\n", statement.Module, context.context.TranslateSymbol(context.localSymbols[local]))
+	default:
+		line = fmt.Sprintf("import %s\n", statement.Module)
+	}
+	outFile.Write([]byte(line))
+}
+
+/*
+	Registers the given (already written) combined file as a module in sys.modules,
+	so that dynamic imports of it find its translated symbols.
+*/
+func writeModuleRegistration(context *FileContext, outFile *os.File) {
+
+	outFile.Write([]byte(fmt.Sprintf("__coiler_register_module__(%s, {%s})\n", pythonString(context.namespace), strings.Join(translatedSymbols(context), ", "))))
+}
+
+/*
+	Returns python dictionary entries mapping each symbol of the given [context] (including those it imports) to its translated name, ordered by name.
+*/
+func translatedSymbols(context *FileContext) []string {
+
+	var ret []string
+	var translated string
+
+	for _, name := range context.GetModuleNames() {
+
+		translated = context.context.TranslateSymbol(context.qualify(name))
+		if translated != "" {
+			ret = append(ret, fmt.Sprintf("%s: %s", pythonString(name), pythonString(translated)))
+		}
+	}
+	return ret
+}
+
+/*
+	Writes the given [dataFiles] into a '__coiler_data__' dictionary, keyed by name.
+	Contents are base64-encoded, so that they can be embedded verbatim regardless of python version.
+*/
+func writeDataFiles(dataFiles map[string]string, outFile *os.File) error {
+
+	var names []string
+	var contents []byte
+	var line string
+	var err error
+
+	if len(dataFiles) == 0 {
+		return nil
+	}
+
+	for name, _ := range dataFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	outFile.Write([]byte("import base64 as __coiler_base64__\n__coiler_data__ = {}\n"))
+
+	for _, name := range names {
+
+		contents, err = ioutil.ReadFile(dataFiles[name])
+		if err != nil {
+			return err
+		}
+
+		line = fmt.Sprintf("__coiler_data__[%s] = __coiler_base64__.b64decode('%s')\n", pythonString(name), base64.StdEncoding.EncodeToString(contents))
+		outFile.Write([]byte(line))
+	}
+
+	outFile.Write([]byte("del __coiler_base64__\n"))
+	return nil
+}
+
+/*
+	Translates and writes the given combined file.
+	Files other than the entry point are written as libraries; their 'if __name__ == "__main__":' blocks are left out,
+	and their module attributes (which would otherwise be those of the entry point) are bound as constants of their own.
+*/
 func writeTranslatedFile(context *FileContext, outFile *os.File) error {
 
-	var sourceFile *os.File
+	var contents []byte
 	var sourceReader *bufio.Reader
 	var line string
 	var rawLine []byte
+	var restorations [][]string
+	var skipped, chained map[int]bool
+	var lineNumber int
+	var isLibrary, preserveNames bool
 	var err error
 
-	sourceFile, err = os.Open(context.fullPath)
+	isLibrary = context.fullPath != context.context.entryPoint
+	preserveNames = context.context.options.PreserveNames
+
+	// combined files may be within an archive, rather than a file of their own.
+	contents, err = readSourceFile(context.fullPath)
 	if err != nil {
 		return err
 	}
-	defer sourceFile.Close()
 
-	sourceReader = bufio.NewReader(sourceFile)
+	if isLibrary {
+		skipped, chained = findMainBlocks(string(contents))
+		writeModuleAttributes(context, outFile)
+	}
+
+	sourceReader = bufio.NewReader(bytes.NewReader(contents))
 
 	for {
 		rawLine, err = sourceReader.ReadBytes('\n')
 		if err != nil {
-			if err == io.EOF {
+			if err != io.EOF {
+				return err
+			}
+
+			if len(rawLine) == 0 {
 				break
 			}
-			return err
+
+			// a final line without a newline
+			rawLine = append(rawLine, '\n')
+		}
+
+		line = string(rawLine)
+		lineNumber++
+
+		if skipped[lineNumber] {
+			continue
+		}
+
+		// the skipped condition is always false, so anything chained onto it becomes a plain 'if'.
+		if chained[lineNumber] {
+			line = elseRegex.ReplaceAllStringFunc(line, func(match string) string {
+				if strings.HasPrefix(match, "else") {
+					return "if True:"
+				}
+				return "if"
+			})
+		}
+
+		// the translator leaves out top-level imports, those of external modules are written again (binding translated names).
+		if !context.translator.isPending() {
+
+			for _, statement := range context.externalImports[lineNumber] {
+				writeExternalImport(context, statement, outFile)
+			}
 		}
 
-		line = context.TranslateLine(string(rawLine))
+		line = context.TranslateLine(line)
 		outFile.Write([]byte(line))
+
+		if preserveNames && len(context.definitions[lineNumber]) > 0 {
+			restorations = append(restorations, context.definitions[lineNumber])
+		}
+
+		// the translation of a logical line is only written once it has ended, restorations must come after it.
+		if !context.translator.isPending() {
+
+			for _, names := range restorations {
+				writeNameRestoration(context, names, outFile)
+			}
+			restorations = nil
+		}
+
+		if err == io.EOF {
+			break
+		}
 	}
 	return nil
 }
+
+/*
+	Finds every top-level 'if __name__ == "__main__":' block in the given [source].
+	Returns the (1-based) physical lines of each block, including its header and anything up to the next top-level statement,
+	and the first line of any 'elif' or 'else' chained directly onto one.
+	Blocks are found by logical line, so that strings and bracketed expressions within them can't end them early.
+*/
+func findMainBlocks(source string) (map[int]bool, map[int]bool) {
+
+	var skipped, chained map[int]bool
+	var physicalLines []string
+	var start int
+
+	skipped = make(map[int]bool)
+	chained = make(map[int]bool)
+	physicalLines = strings.Split(source, "\n")
+	start = 0
+
+	// marks every line from the header of the current block up to (but not including) the given line.
+	closeBlock := func(end int) {
+
+		for line := start; line < end; line++ {
+			skipped[line] = true
+		}
+		start = 0
+	}
+
+	for _, line := range readLogicalLines(source) {
+
+		if line.indent > 0 {
+			continue
+		}
+
+		if start > 0 {
+
+			closeBlock(line.line)
+
+			switch identifierRegex.FindString(line.text) {
+			case "elif", "else":
+				chained[line.line] = true
+			}
+		}
+
+		// strings are masked in logical lines, so the header is matched against the source itself.
+		if mainBlockRegex.MatchString(physicalLines[line.line-1]) {
+			start = line.line
+		}
+	}
+
+	if start > 0 {
+		closeBlock(len(physicalLines) + 1)
+	}
+	return skipped, chained
+}
+
+/*
+	Writes the module attributes of the given (library) [context] as constants, bound once before the file's own code.
+	Each is translated like any other symbol of the file, so the file may still rebind it, or take it as a parameter.
+*/
+func writeModuleAttributes(context *FileContext, outFile *os.File) {
+
+	var value string
+
+	for _, name := range moduleAttributeNames {
+
+		switch name {
+		case "__name__":
+			value = context.namespace
+		case "__file__":
+			value = context.fullPath
+		case "__package__":
+			// combined modules are always top-level.
+			value = ""
+		}
+
+		outFile.Write([]byte(fmt.Sprintf("%s = %s\n", context.context.TranslateSymbol(context.qualify(name)), pythonString(value))))
+	}
+}
+
+/*
+	Returns the given [value] as a python string literal, which python 2 and 3 both read as the same characters.
+	Go's escapes aren't python's, so the literal is kept pure ascii; other characters are written as '\u' escapes (of a unicode literal),
+	and bytes which aren't UTF-8 as the surrogates python 3 decodes them to, as it does in file names.
+*/
+func pythonString(value string) string {
+
+	var buffer bytes.Buffer
+	var character rune
+	var size int
+	var unicode bool
+
+	for index := 0; index < len(value); index += size {
+
+		character, size = utf8.DecodeRuneInString(value[index:])
+
+		switch {
+		case character == utf8.RuneError && size == 1:
+			buffer.WriteString(fmt.Sprintf("\\udc%02x", value[index]))
+			unicode = true
+		case character == '"' || character == '\\':
+			buffer.WriteByte('\\')
+			buffer.WriteRune(character)
+		case character < 0x20 || character == 0x7f:
+			buffer.WriteString(fmt.Sprintf("\\x%02x", character))
+		case character < 0x80:
+			buffer.WriteRune(character)
+		case character > 0xFFFF:
+			buffer.WriteString(fmt.Sprintf("\\U%08x", character))
+			unicode = true
+		default:
+			buffer.WriteString(fmt.Sprintf("\\u%04x", character))
+			unicode = true
+		}
+	}
+
+	if unicode {
+		return "u\"" + buffer.String() + "\""
+	}
+	return "\"" + buffer.String() + "\""
+}
@@ -0,0 +1,147 @@
+package coiler
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindMainBlocks(test *testing.T) {
+
+	var source string
+	var skipped, chained, expected map[int]bool
+
+	source = `value = 1
+if __name__ == "__main__":
+    doc = """
+leaked = 1
+"""
+    items = [
+2]
+
+elif value:
+    other = 1
+if __name__ == '__main__': print("one line")
+after = 2
+if __name__ == "__main__":
+    last = 3`
+
+	skipped, chained = findMainBlocks(source)
+
+	expected = map[int]bool{2: true, 3: true, 4: true, 5: true, 6: true, 7: true, 8: true, 11: true, 13: true, 14: true}
+	if !reflect.DeepEqual(skipped, expected) {
+		test.Errorf("expected lines %v to be skipped, got %v", expected, skipped)
+	}
+
+	expected = map[int]bool{9: true}
+	if !reflect.DeepEqual(chained, expected) {
+		test.Errorf("expected lines %v to be chained, got %v", expected, chained)
+	}
+}
+
+/*
+	Module attributes of combined files are constants of their own, so they can still be rebound, or be the names of parameters.
+*/
+func TestModuleAttributes(test *testing.T) {
+
+	var session *BuildSession
+	var context *BuildContext
+	var output []byte
+	var outputPath, interpreter string
+	var err error
+
+	root, err := ioutil.TempDir("", "coiler-attributes")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	err = ioutil.WriteFile(filepath.Join(root, "main.py"), []byte("import helper\nprint(helper.describe())\n"), 0644)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(root, "helper.py"), []byte(
+			"original = __name__\n"+
+				"__name__ = 'renamed'\n"+
+				"def f(__file__=None):\n"+
+				"    return __file__ or __package__ or 'none'\n"+
+				"def describe():\n"+
+				"    return ' '.join([original, __name__, f(), f(__file__='given'), cls.__name__])\n"+
+				"class cls: pass\n"), 0644)
+	}
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	session = &BuildSession{
+		lookupPaths: []string{root},
+		lookupFiles: determineLookupFiles([]string{root}),
+		cache:       NewParseCache(""),
+	}
+
+	context, err = session.Parse(filepath.Join(root, "main.py"))
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	outputPath = filepath.Join(root, "combined.py")
+	err = writeCombinedOutput(outputPath, context)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	output, err = ioutil.ReadFile(outputPath)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"helper_ZC___name__ = \"helper\"\n",
+		"helper_ZC___package__ = \"\"\n",
+		"helper_ZC_original = helper_ZC___name__\n",
+		"helper_ZC___name__ = 'renamed'\n",
+		"def helper_ZC_f(helper_ZC___file__=None):\n",
+		"helper_ZC_f(helper_ZC___file__='given'), helper_ZC_cls.__name__",
+	} {
+		if !strings.Contains(string(output), expected) {
+			test.Errorf("expected the combined output to contain %q, got:\n%s", expected, output)
+		}
+	}
+
+	// the output is only run if there's an interpreter to run it.
+	interpreter, err = exec.LookPath("python3")
+	if err != nil {
+		return
+	}
+
+	output, err = exec.Command(interpreter, outputPath).CombinedOutput()
+	if err != nil || string(output) != "helper renamed none given helper_ZC_cls\n" {
+		test.Errorf("expected the combined output to run, got %v:\n%s", err, output)
+	}
+}
+
+func TestPythonString(test *testing.T) {
+
+	var cases = []struct {
+		value    string
+		expected string
+	}{
+		{"", `""`},
+		{"/home/user/helper.py", `"/home/user/helper.py"`},
+		{`say "hi" \ bye`, `"say \"hi\" \\ bye"`},
+		{"tab\tnewline\ndelete\x7f", `"tab\x09newline\x0adelete\x7f"`},
+		{"caf\u00e9", `u"caf\u00e9"`},
+		{"\U0001f40d", `u"\U0001f40d"`},
+		{"bad\xffbyte", `u"bad\udcffbyte"`},
+	}
+
+	for _, testCase := range cases {
+
+		actual := pythonString(testCase.value)
+		if actual != testCase.expected {
+			test.Errorf("expected %q to be written as %s, got %s", testCase.value, testCase.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package coiler
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+/*
+	Describes a virtualenv (made by either 'venv' or 'virtualenv'), as read from its 'pyvenv.cfg', without activating it.
+*/
+type VirtualEnv struct {
+
+	// the (absolute) root directory of the virtualenv.
+	Path string
+
+	// the interpreter the virtualenv was made from, which provides the standard library.
+	BaseInterpreter string
+
+	// the virtualenv's own interpreter, which runs with its site-packages on the search path.
+	Interpreter string
+
+	// the virtualenv's site-packages directories, in order.
+	SitePackages []string
+
+	// if true, the base interpreter's own site-packages are also searched, after the virtualenv's.
+	IncludeSystemSitePackages bool
+}
+
+/*
+	Reads the virtualenv at the given [path].
+	Returns an error if it isn't a virtualenv, or if the interpreter it was made from no longer exists.
+*/
+func OpenVirtualEnv(path string) (*VirtualEnv, error) {
+
+	var ret *VirtualEnv
+	var config map[string]string
+	var err error
+
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err = readVirtualEnvConfig(filepath.Join(path, "pyvenv.cfg"))
+	if err != nil {
+
+		errorMsg := fmt.Sprintf("'%s' isn't a virtualenv, it has no readable 'pyvenv.cfg': %v", path, err)
+		return nil, errors.New(errorMsg)
+	}
+
+	ret = new(VirtualEnv)
+	ret.Path = path
+	ret.IncludeSystemSitePackages = strings.ToLower(config["include-system-site-packages"]) == "true"
+
+	ret.BaseInterpreter = findBaseInterpreter(config)
+	if ret.BaseInterpreter == "" {
+
+		errorMsg := fmt.Sprintf("Unable to find the interpreter virtualenv '%s' was made from (its 'home' is '%s')", path, config["home"])
+		return nil, errors.New(errorMsg)
+	}
+
+	ret.SitePackages = findSitePackages(path, config)
+	if len(ret.SitePackages) == 0 {
+
+		errorMsg := fmt.Sprintf("Virtualenv '%s' has no site-packages directory", path)
+		return nil, errors.New(errorMsg)
+	}
+
+	if runtime.GOOS == "windows" {
+		ret.Interpreter = filepath.Join(path, "Scripts", "python.exe")
+	} else {
+		ret.Interpreter = filepath.Join(path, "bin", "python")
+	}
+
+	if !isFile(ret.Interpreter) {
+		ret.Interpreter = ret.BaseInterpreter
+	}
+
+	return ret, nil
+}
+
+/*
+	Reads the 'key = value' lines of the 'pyvenv.cfg' at the given [path]. Keys are lowercased.
+*/
+func readVirtualEnvConfig(path string) (map[string]string, error) {
+
+	var ret map[string]string
+	var contents []byte
+	var key, value string
+	var index int
+	var err error
+
+	contents, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ret = make(map[string]string)
+
+	for _, line := range strings.Split(string(contents), "\n") {
+
+		index = strings.Index(line, "=")
+		if index < 0 {
+			continue
+		}
+
+		key = strings.ToLower(strings.TrimSpace(line[:index]))
+		value = strings.TrimSpace(line[index+1:])
+		ret[key] = value
+	}
+	return ret, nil
+}
+
+/*
+	Finds the interpreter a virtualenv was made from, given its [config].
+	'virtualenv' records it as 'base-executable', 'venv' (since python 3.11) as 'executable'.
+	Otherwise, it's the python found in the 'home' directory, preferring the one whose version matches.
+	Returns an empty string if none of them exist.
+*/
+func findBaseInterpreter(config map[string]string) string {
+
+	var candidates []string
+	var home, version string
+
+	candidates = append(candidates, config["base-executable"], config["executable"])
+
+	home = config["home"]
+	if home != "" {
+
+		version = majorMinorVersion(config)
+
+		if runtime.GOOS == "windows" {
+			candidates = append(candidates, filepath.Join(home, "python.exe"))
+		} else {
+
+			if version != "" {
+				candidates = append(candidates, filepath.Join(home, "python"+version))
+			}
+			candidates = append(candidates, filepath.Join(home, "python3"), filepath.Join(home, "python"))
+		}
+	}
+
+	for _, candidate := range candidates {
+		if candidate != "" && isFile(candidate) {
+			return candidate
+		}
+	}
+	return ""
+}
+
+/*
+	Finds the site-packages directories of the virtualenv at the given [path].
+	On windows (and for pypy) they're directly under the root, otherwise they're within a directory named for the python version.
+	If more than one version is present, the one the virtualenv's [config] names comes first.
+*/
+func findSitePackages(path string, config map[string]string) []string {
+
+	var ret, matches []string
+	var version string
+
+	version = majorMinorVersion(config)
+
+	for _, candidate := range []string{filepath.Join(path, "Lib", "site-packages"), filepath.Join(path, "site-packages")} {
+		if isDirectory(candidate) {
+			ret = append(ret, candidate)
+		}
+	}
+
+	// 'lib64' is normally a link to 'lib', and so isn't searched separately.
+	matches, _ = filepath.Glob(filepath.Join(path, "lib", "python*", "site-packages"))
+	sort.SliceStable(matches, func(i, j int) bool {
+		return version != "" && filepath.Base(filepath.Dir(matches[i])) == "python"+version && filepath.Base(filepath.Dir(matches[j])) != "python"+version
+	})
+
+	for _, match := range matches {
+		if isDirectory(match) {
+			ret = append(ret, match)
+		}
+	}
+	return ret
+}
+
+/*
+	Returns the 'major.minor' python version recorded in the given virtualenv [config], or an empty string if there isn't one.
+	'venv' records it as 'version', 'virtualenv' as 'version_info'.
+*/
+func majorMinorVersion(config map[string]string) string {
+
+	var version string
+	var parts []string
+
+	version = config["version"]
+	if version == "" {
+		version = config["version_info"]
+	}
+
+	parts = strings.Split(version, ".")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[0] + "." + parts[1]
+}
+
+/*
+	Places the given virtualenv's site-packages among the given interpreter lookup [paths], where python would put them;
+	just before the base interpreter's own site directories (or last, if it has none).
+	The base interpreter's site directories are dropped, unless the virtualenv includes system site-packages.
+*/
+func addVirtualEnvPaths(paths []string, virtualEnv *VirtualEnv) []string {
+
+	var ret []string
+	var added bool
+
+	for _, path := range paths {
+
+		if !isSiteDirectory(path) {
+
+			ret = append(ret, path)
+			continue
+		}
+
+		if !added {
+
+			ret = append(ret, virtualEnv.SitePackages...)
+			added = true
+		}
+
+		if virtualEnv.IncludeSystemSitePackages {
+			ret = append(ret, path)
+		}
+	}
+
+	if !added {
+		ret = append(ret, virtualEnv.SitePackages...)
+	}
+	return ret
+}
+
+func isFile(path string) bool {
+
+	var info os.FileInfo
+	var err error
+
+	info, err = os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+func isDirectory(path string) bool {
+
+	var info os.FileInfo
+	var err error
+
+	info, err = os.Stat(path)
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,993 @@
+package coiler
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	A single requirement, as given by a requirements (or lock) file.
+*/
+type requirement struct {
+
+	// the project name, normalized (see normalizeProjectName).
+	name string
+
+	// the requirement as written, for messages.
+	text string
+
+	// where the requirement was written, for messages.
+	source string
+	line   int
+
+	specifiers []versionSpecifier
+
+	// if given, the sha256 of the wheel used must be one of these.
+	hashes []string
+
+	// the requirement's environment marker, if it has one. It only applies to interpreters for which the marker holds.
+	marker *markerExpression
+}
+
+type versionSpecifier struct {
+	operator string
+	version  string
+}
+
+/*
+	A wheel which has been unpacked to be searched for modules, and the requirement which picked it.
+*/
+type UnpackedWheel struct {
+
+	// the directory the wheel was unpacked into.
+	Path string
+
+	// the wheel's file name.
+	Name string
+
+	// the requirement which picked the wheel, as written, and where it was written ('requirements.txt:3').
+	Requirement string
+	Location    string
+}
+
+/*
+	A '.whl' file in a wheelhouse, described by its file name.
+*/
+type wheelFile struct {
+	path        string
+	name        string
+	version     string
+	pythonTag   string
+	abiTag      string
+	platformTag string
+}
+
+/*
+	A parsed version number, as described by PEP 440.
+*/
+type packageVersion struct {
+	epoch   int
+	release []int
+
+	// pre-release kind (0 for 'a', 1 for 'b', 2 for 'rc') and number. The kind is 3 for a final release,
+	// and -1 for a development release of a final release, so that these sort correctly.
+	preKind   int
+	preNumber int
+
+	// -1 if this isn't a post-release.
+	post int
+
+	// -1 if this isn't a development release.
+	dev int
+}
+
+var requirementRegex *regexp.Regexp
+var specifierRegex *regexp.Regexp
+var wheelNameRegex *regexp.Regexp
+var versionRegex *regexp.Regexp
+var projectNameSeparatorRegex *regexp.Regexp
+
+// the abbreviations which wheel tags use for each python implementation (by its 'implementation_name').
+var pythonImplementationTags map[string]string
+
+func init() {
+	requirementRegex = regexp.MustCompile("^([A-Za-z0-9](?:[A-Za-z0-9._-]*[A-Za-z0-9])?)\\s*(?:\\[[^\\]]*\\])?\\s*\\(?([^;()]*)\\)?\\s*(;.*)?$")
+	specifierRegex = regexp.MustCompile("^\\s*(~=|===|==|!=|<=|>=|<|>)\\s*([^\\s,]+)\\s*$")
+	wheelNameRegex = regexp.MustCompile("^([^-]+)-([^-]+)(?:-\\d[^-]*)?-([^-]+)-([^-]+)-([^-]+)\\.whl$")
+	versionRegex = regexp.MustCompile("^v?(?:(\\d+)!)?(\\d+(?:\\.\\d+)*)(?:[-_.]?(a|b|c|rc|alpha|beta|pre|preview)[-_.]?(\\d*))?(?:-(\\d+)|[-_.]?(post|rev|r)[-_.]?(\\d*))?(?:[-_.]?(dev)[-_.]?(\\d*))?(?:\\+[a-z0-9]+(?:[-_.][a-z0-9]+)*)?$")
+	projectNameSeparatorRegex = regexp.MustCompile("[-_.]+")
+
+	pythonImplementationTags = map[string]string{
+		"cpython":    "cp",
+		"pypy":       "pp",
+		"ironpython": "ip",
+		"jython":     "jy",
+	}
+}
+
+/*
+	Picks a wheel from the given [wheelhouse] directory for each requirement in the requirements (or lock) file at [requirementsPath],
+	without using a network, and unpacks each into its own directory within the given [directory].
+	Requirements whose environment markers don't hold for the given [interpreter] are left out, as are wheels it couldn't install.
+	Returns the unpacked wheels, in the order their requirements were given, whose directories are to be used as lookup paths.
+	Wheels are unpacked once, and reused by later builds for as long as they're in the [directory]. Anything already in it is trusted,
+	so it must be a directory only the current user can write to (see makePrivateDirectory).
+	Only pure-python wheels can be combined. If the only wheels which satisfy a requirement contain native code, an error is returned.
+	Requirements aren't resolved; every package needed has to be listed, as it is in a lock file.
+*/
+func UnpackWheelhouse(wheelhouse string, requirementsPath string, directory string, interpreter string) ([]UnpackedWheel, error) {
+
+	var ret []UnpackedWheel
+	var requirements []requirement
+	var wheels map[string][]wheelFile
+	var environment markerEnvironment
+	var wheel *wheelFile
+	var hash, unpacked string
+	var applies bool
+	var err error
+
+	requirements, err = readRequirements(requirementsPath, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+
+	wheels, err = findWheels(wheelhouse)
+	if err != nil {
+		return nil, err
+	}
+
+	environment, err = readMarkerEnvironment(interpreter)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, requirement := range requirements {
+
+		if requirement.marker != nil {
+
+			applies, err = requirement.marker.evaluate(environment)
+			if err != nil {
+
+				errorMsg := fmt.Sprintf("%s:%d: %v", requirement.source, requirement.line, err)
+				return nil, errors.New(errorMsg)
+			}
+
+			if !applies {
+				continue
+			}
+		}
+
+		wheel, hash, err = selectWheel(requirement, wheels[requirement.name], environment)
+		if err != nil {
+			return nil, err
+		}
+
+		if wheel == nil {
+
+			errorMsg := fmt.Sprintf("%s:%d: no wheel in '%s' satisfies '%s'", requirement.source, requirement.line, wheelhouse, requirement.text)
+			if len(requirement.hashes) > 0 {
+				errorMsg += " and matches one of its hashes"
+			}
+			errorMsg += fmt.Sprintf(" for %s %s", environment["implementation_name"], environment["python_full_version"])
+			return nil, errors.New(errorMsg)
+		}
+
+		if !isPureWheel(*wheel) {
+
+			errorMsg := fmt.Sprintf("%s:%d: '%s' can only be satisfied by '%s', which contains native code and so can't be combined. "+
+				"Add a pure-python wheel for it to the wheelhouse, or install it where the output runs instead of listing it",
+				requirement.source, requirement.line, requirement.text, filepath.Base(wheel.path))
+			return nil, errors.New(errorMsg)
+		}
+
+		unpacked, err = unpackWheel(*wheel, hash, directory)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, UnpackedWheel{
+			Path:        unpacked,
+			Name:        filepath.Base(wheel.path),
+			Requirement: requirement.text,
+			Location:    fmt.Sprintf("%s:%d", requirement.source, requirement.line),
+		})
+	}
+	return ret, nil
+}
+
+/*
+	Reads every requirement in the requirements file at the given [requirementsPath], including those of any files it includes with '-r'.
+	Lines may be continued with a trailing backslash. Options other than '-r' and '--hash' (such as '--index-url') are ignored,
+	since nothing is downloaded. [visited] holds the files already read, so that an include cycle is read only once.
+*/
+func readRequirements(requirementsPath string, visited map[string]bool) ([]requirement, error) {
+
+	var ret, included []requirement
+	var parsed requirement
+	var contents []byte
+	var lines []string
+	var logical, includedPath string
+	var start int
+	var err error
+
+	requirementsPath, err = filepath.Abs(requirementsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if visited[requirementsPath] {
+		return nil, nil
+	}
+	visited[requirementsPath] = true
+
+	contents, err = ioutil.ReadFile(requirementsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	lines = strings.Split(strings.ReplaceAll(string(contents), "\r\n", "\n"), "\n")
+
+	for index := 0; index < len(lines); index++ {
+
+		start = index + 1
+		logical = lines[index]
+
+		for strings.HasSuffix(logical, "\\") && index+1 < len(lines) {
+
+			index++
+			logical = strings.TrimSuffix(logical, "\\") + " " + lines[index]
+		}
+
+		logical = stripRequirementComment(logical)
+		if logical == "" {
+			continue
+		}
+
+		if strings.HasPrefix(logical, "-r ") || strings.HasPrefix(logical, "--requirement") {
+
+			includedPath = strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(logical, "-r "), "--requirement"))
+			includedPath = strings.TrimSpace(strings.TrimPrefix(includedPath, "="))
+			if !filepath.IsAbs(includedPath) {
+				includedPath = filepath.Join(filepath.Dir(requirementsPath), includedPath)
+			}
+
+			included, err = readRequirements(includedPath, visited)
+			if err != nil {
+				return nil, err
+			}
+
+			ret = append(ret, included...)
+			continue
+		}
+
+		if strings.HasPrefix(logical, "-e ") || strings.HasPrefix(logical, "--editable") {
+
+			errorMsg := fmt.Sprintf("%s:%d: editable requirements can't come from a wheelhouse", requirementsPath, start)
+			return nil, errors.New(errorMsg)
+		}
+
+		if strings.HasPrefix(logical, "-") {
+			continue
+		}
+
+		parsed, err = parseRequirement(logical)
+		if err != nil {
+
+			errorMsg := fmt.Sprintf("%s:%d: %v", requirementsPath, start, err)
+			return nil, errors.New(errorMsg)
+		}
+
+		parsed.source = requirementsPath
+		parsed.line = start
+		ret = append(ret, parsed)
+	}
+	return ret, nil
+}
+
+/*
+	Removes a comment (which starts at a '#' at the start of the line or after whitespace) from the given [line], and trims it.
+*/
+func stripRequirementComment(line string) string {
+
+	for index, character := range line {
+
+		if character == '#' && (index == 0 || line[index-1] == ' ' || line[index-1] == '\t') {
+			line = line[:index]
+			break
+		}
+	}
+	return strings.TrimSpace(line)
+}
+
+/*
+	Parses a single requirement [line], such as 'requests[socks]>=2.0,<3 ; python_version >= "3.8" --hash=sha256:...'.
+*/
+func parseRequirement(line string) (requirement, error) {
+
+	var ret requirement
+	var fields, options []string
+	var matches, specifierMatches []string
+	var hash string
+	var err error
+
+	// '--hash' options follow the requirement itself.
+	fields = strings.Fields(line)
+	for len(fields) > 0 && strings.HasPrefix(fields[len(fields)-1], "--") {
+
+		options = append(options, fields[len(fields)-1])
+		fields = fields[:len(fields)-1]
+	}
+
+	for _, option := range options {
+
+		if !strings.HasPrefix(option, "--hash=") {
+			continue
+		}
+
+		hash = strings.TrimPrefix(option, "--hash=")
+		if !strings.HasPrefix(hash, "sha256:") {
+
+			errorMsg := fmt.Sprintf("only sha256 hashes are supported, not '%s'", hash)
+			return ret, errors.New(errorMsg)
+		}
+		ret.hashes = append(ret.hashes, strings.ToLower(strings.TrimPrefix(hash, "sha256:")))
+	}
+
+	ret.text = strings.Join(fields, " ")
+
+	if strings.Contains(ret.text, "://") || strings.Contains(ret.text, " @ ") || strings.HasSuffix(ret.text, ".whl") {
+
+		errorMsg := fmt.Sprintf("'%s' names a file or URL; only requirements by name can come from a wheelhouse", ret.text)
+		return ret, errors.New(errorMsg)
+	}
+
+	matches = requirementRegex.FindStringSubmatch(ret.text)
+	if matches == nil {
+
+		errorMsg := fmt.Sprintf("'%s' isn't a valid requirement", ret.text)
+		return ret, errors.New(errorMsg)
+	}
+
+	ret.name = normalizeProjectName(matches[1])
+
+	if matches[3] != "" {
+
+		ret.marker, err = parseMarker(strings.TrimSpace(strings.TrimPrefix(matches[3], ";")))
+		if err != nil {
+			return ret, err
+		}
+	}
+
+	for _, specifier := range strings.Split(matches[2], ",") {
+
+		if strings.TrimSpace(specifier) == "" {
+			continue
+		}
+
+		specifierMatches = specifierRegex.FindStringSubmatch(specifier)
+		if specifierMatches == nil {
+
+			errorMsg := fmt.Sprintf("'%s' isn't a valid version specifier", strings.TrimSpace(specifier))
+			return ret, errors.New(errorMsg)
+		}
+
+		ret.specifiers = append(ret.specifiers, versionSpecifier{operator: specifierMatches[1], version: specifierMatches[2]})
+	}
+	return ret, nil
+}
+
+/*
+	Finds every wheel in the given [wheelhouse] directory. Returns a map of (normalized) project names to their wheels.
+*/
+func findWheels(wheelhouse string) (map[string][]wheelFile, error) {
+
+	var ret map[string][]wheelFile
+	var paths []string
+	var matches []string
+	var wheel wheelFile
+	var err error
+
+	if !isDirectory(wheelhouse) {
+
+		errorMsg := fmt.Sprintf("Wheelhouse '%s' isn't a directory", wheelhouse)
+		return nil, errors.New(errorMsg)
+	}
+
+	paths, err = filepath.Glob(filepath.Join(wheelhouse, "*.whl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	ret = make(map[string][]wheelFile)
+
+	for _, wheelPath := range paths {
+
+		matches = wheelNameRegex.FindStringSubmatch(filepath.Base(wheelPath))
+		if matches == nil {
+			continue
+		}
+
+		wheel = wheelFile{
+			path:        wheelPath,
+			name:        normalizeProjectName(matches[1]),
+			version:     matches[2],
+			pythonTag:   matches[3],
+			abiTag:      matches[4],
+			platformTag: matches[5],
+		}
+		ret[wheel.name] = append(ret[wheel.name], wheel)
+	}
+	return ret, nil
+}
+
+/*
+	Chooses the wheel which best satisfies the given [requirement] from the given [wheels] (all of the same project).
+	Only wheels whose python tag suits the interpreter described by [environment] are considered.
+	Pure-python wheels are preferred over native ones, then final releases over pre-releases, then higher versions.
+	If the requirement lists hashes, only wheels which match one of them are considered.
+	Returns the wheel and its sha256 (or nil, if none satisfy the requirement).
+*/
+func selectWheel(requirement requirement, wheels []wheelFile, environment markerEnvironment) (*wheelFile, string, error) {
+
+	var candidates []wheelFile
+	var hashes []string
+	var hash string
+	var err error
+
+	for _, wheel := range wheels {
+
+		if !isCompatiblePythonTag(wheel.pythonTag, environment) || !satisfiesSpecifiers(wheel.version, requirement.specifiers) {
+			continue
+		}
+
+		hash, err = hashFile(wheel.path)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if len(requirement.hashes) > 0 && !containsString(requirement.hashes, hash) {
+			continue
+		}
+
+		candidates = append(candidates, wheel)
+		hashes = append(hashes, hash)
+	}
+
+	if len(candidates) == 0 {
+		return nil, "", nil
+	}
+
+	best := 0
+	for index := 1; index < len(candidates); index++ {
+		if preferWheel(candidates[index], candidates[best]) {
+			best = index
+		}
+	}
+	return &candidates[best], hashes[best], nil
+}
+
+/*
+	Returns true if wheel [a] should be chosen over wheel [b].
+*/
+func preferWheel(a wheelFile, b wheelFile) bool {
+
+	var versionA, versionB packageVersion
+	var validA, validB bool
+
+	if isPureWheel(a) != isPureWheel(b) {
+		return isPureWheel(a)
+	}
+
+	versionA, validA = parseVersion(a.version)
+	versionB, validB = parseVersion(b.version)
+
+	if !validA || !validB {
+		return validA && !validB
+	}
+
+	if versionA.isPreRelease() != versionB.isPreRelease() {
+		return !versionA.isPreRelease()
+	}
+	return compareVersions(versionA, versionB) > 0
+}
+
+/*
+	Returns true if the given python [tag] of a wheel (such as 'py3', 'py2.py3', 'py38' or 'cp311') allows it to be installed by the interpreter
+	described by [environment], as pip decides for pure-python wheels: a generic 'py' tag suits any interpreter of the same major version
+	(and, if it names a minor version, any later minor version), and an implementation's own tag only suits that exact implementation and version.
+*/
+func isCompatiblePythonTag(tag string, environment markerEnvironment) bool {
+
+	var version []string
+	var major, minor, prefix, digits string
+
+	version = strings.SplitN(environment["python_version"], ".", 2)
+	if len(version) != 2 {
+		return false
+	}
+	major, minor = version[0], version[1]
+
+	for _, single := range strings.Split(tag, ".") {
+
+		if len(single) < 3 {
+			continue
+		}
+
+		prefix, digits = single[:2], single[2:]
+		if _, err := strconv.Atoi(digits); err != nil {
+			continue
+		}
+
+		switch prefix {
+		case "py":
+
+			if digits[:1] != major {
+				continue
+			}
+
+			if len(digits) == 1 || compareNumbers(digits[1:], minor) <= 0 {
+				return true
+			}
+
+		case pythonImplementationTags[environment["implementation_name"]]:
+
+			if digits == major+minor {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+	Compares two strings of digits as numbers, returning a negative number if [a] is smaller, a positive number if it's larger, or zero if they're equal.
+*/
+func compareNumbers(a string, b string) int {
+
+	var numberA, numberB int
+
+	numberA, _ = strconv.Atoi(a)
+	numberB, _ = strconv.Atoi(b)
+	return numberA - numberB
+}
+
+/*
+	Returns true if the given [wheel] contains no native code, as far as its tags say.
+*/
+func isPureWheel(wheel wheelFile) bool {
+	return wheel.abiTag == "none" && wheel.platformTag == "any"
+}
+
+/*
+	Unpacks the given [wheel] into its own directory within [directory], named for its project, version and [hash].
+	If it has already been unpacked there, it's reused. Files meant for the installed 'purelib' or 'platlib' are unpacked alongside
+	the wheel's own modules; scripts, headers and data files aren't needed to import it, and so are left out.
+	Returns an error if the wheel contains an extension module, whatever its tags say.
+*/
+func unpackWheel(wheel wheelFile, hash string, directory string) (string, error) {
+
+	var reader *zip.ReadCloser
+	var target, partial, name, destination string
+	var err error
+
+	target = filepath.Join(directory, wheel.name+"-"+wheel.version+"-"+hash[:16])
+	if isDirectory(target) {
+		return target, nil
+	}
+
+	err = os.MkdirAll(directory, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	reader, err = zip.OpenReader(wheel.path)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	for _, file := range reader.File {
+		if isExtensionFile(file.Name) {
+
+			errorMsg := fmt.Sprintf("Wheel '%s' contains native code ('%s'), so it can't be combined", filepath.Base(wheel.path), file.Name)
+			return "", errors.New(errorMsg)
+		}
+	}
+
+	// unpacked to a temporary directory first, so that a build which is interrupted (or runs alongside another) never sees half a wheel.
+	partial, err = ioutil.TempDir(directory, ".unpacking-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(partial)
+
+	for _, file := range reader.File {
+
+		name = wheelInstallPath(file.Name)
+		if name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+
+		if path.IsAbs(name) || name != path.Clean(name) || strings.HasPrefix(name, "../") {
+
+			errorMsg := fmt.Sprintf("Wheel '%s' contains a file outside of itself ('%s')", filepath.Base(wheel.path), file.Name)
+			return "", errors.New(errorMsg)
+		}
+
+		destination = filepath.Join(partial, filepath.FromSlash(name))
+
+		err = extractZipFile(file, destination)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = os.Rename(partial, target)
+	if err != nil && !isDirectory(target) {
+		return "", err
+	}
+	return target, nil
+}
+
+/*
+	Creates the given [directory] (and any parents) if it doesn't exist, and makes sure only the current user can write to it,
+	so that nobody else can put something in it to be combined. Returns an error if it's a link, belongs to another user,
+	or could already have been written to by other users.
+*/
+func makePrivateDirectory(directory string) error {
+
+	var info os.FileInfo
+	var err error
+
+	err = os.MkdirAll(directory, 0700)
+	if err != nil {
+		return err
+	}
+
+	info, err = os.Lstat(directory)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+
+		errorMsg := fmt.Sprintf("'%s' isn't a directory", directory)
+		return errors.New(errorMsg)
+	}
+
+	// windows doesn't have unix permissions, and reports every directory as writable by anyone.
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0022 != 0 {
+
+		errorMsg := fmt.Sprintf("'%s' is writable by other users, so what's in it can't be trusted. Remove it, or use a different cache directory", directory)
+		return errors.New(errorMsg)
+	}
+
+	// only its owner can change a directory's permissions.
+	err = os.Chmod(directory, 0700)
+	if err != nil {
+
+		errorMsg := fmt.Sprintf("'%s' belongs to another user, so what's in it can't be trusted: %v", directory, err)
+		return errors.New(errorMsg)
+	}
+	return nil
+}
+
+/*
+	Returns where the wheel member with the given [name] would be installed, relative to site-packages,
+	or an empty string if it isn't installed there.
+*/
+func wheelInstallPath(name string) string {
+
+	var parts []string
+
+	parts = strings.SplitN(name, "/", 4)
+	if !strings.HasSuffix(parts[0], ".data") {
+		return name
+	}
+
+	if len(parts) == 3 && (parts[1] == "purelib" || parts[1] == "platlib") {
+		return parts[2]
+	}
+
+	if len(parts) == 4 && (parts[1] == "purelib" || parts[1] == "platlib") {
+		return parts[2] + "/" + parts[3]
+	}
+	return ""
+}
+
+/*
+	Returns true if the archive member with the given [name] is an extension module or shared library.
+*/
+func isExtensionFile(name string) bool {
+
+	switch strings.ToLower(path.Ext(name)) {
+	case ".so", ".pyd", ".dylib", ".dll":
+		return true
+	}
+	return strings.Contains(strings.ToLower(path.Base(name)), ".so.")
+}
+
+func extractZipFile(file *zip.File, destination string) error {
+
+	var reader io.ReadCloser
+	var writer *os.File
+	var err error
+
+	err = os.MkdirAll(filepath.Dir(destination), 0755)
+	if err != nil {
+		return err
+	}
+
+	reader, err = file.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err = os.Create(destination)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, reader)
+	if err != nil {
+
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+/*
+	Returns the hex-encoded sha256 of the file at the given [path].
+*/
+func hashFile(path string) (string, error) {
+
+	var file *os.File
+	var err error
+
+	file, err = os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+/*
+	Normalizes a project [name] as PEP 503 does, so that 'Foo_Bar', 'foo-bar' and 'foo.bar' are the same project.
+*/
+func normalizeProjectName(name string) string {
+	return strings.ToLower(projectNameSeparatorRegex.ReplaceAllString(name, "-"))
+}
+
+/*
+	Parses the given [version] string. Returns false if it isn't a valid PEP 440 version.
+*/
+func parseVersion(version string) (packageVersion, bool) {
+
+	var ret packageVersion
+	var matches []string
+
+	matches = versionRegex.FindStringSubmatch(strings.ToLower(strings.TrimSpace(version)))
+	if matches == nil {
+		return ret, false
+	}
+
+	ret.epoch, _ = strconv.Atoi(matches[1])
+
+	for _, part := range strings.Split(matches[2], ".") {
+
+		number, _ := strconv.Atoi(part)
+		ret.release = append(ret.release, number)
+	}
+
+	ret.post = -1
+	if matches[5] != "" {
+		ret.post, _ = strconv.Atoi(matches[5])
+	} else if matches[6] != "" {
+		ret.post, _ = strconv.Atoi(matches[7])
+	}
+
+	ret.dev = -1
+	if matches[8] != "" {
+		ret.dev, _ = strconv.Atoi(matches[9])
+	}
+
+	switch matches[3] {
+	case "a", "alpha":
+		ret.preKind = 0
+	case "b", "beta":
+		ret.preKind = 1
+	case "c", "rc", "pre", "preview":
+		ret.preKind = 2
+	default:
+
+		ret.preKind = 3
+		if ret.dev >= 0 && ret.post < 0 {
+			ret.preKind = -1
+		}
+	}
+	ret.preNumber, _ = strconv.Atoi(matches[4])
+	return ret, true
+}
+
+func (this packageVersion) isPreRelease() bool {
+	return this.preKind < 3 || this.dev >= 0
+}
+
+/*
+	Compares versions [a] and [b], returning a negative number if [a] comes first, a positive number if [b] does, or zero if they're equal.
+*/
+func compareVersions(a packageVersion, b packageVersion) int {
+
+	var partA, partB int
+	var length int
+
+	if a.epoch != b.epoch {
+		return a.epoch - b.epoch
+	}
+
+	length = len(a.release)
+	if len(b.release) > length {
+		length = len(b.release)
+	}
+
+	for index := 0; index < length; index++ {
+
+		partA, partB = 0, 0
+		if index < len(a.release) {
+			partA = a.release[index]
+		}
+		if index < len(b.release) {
+			partB = b.release[index]
+		}
+
+		if partA != partB {
+			return partA - partB
+		}
+	}
+
+	if a.preKind != b.preKind {
+		return a.preKind - b.preKind
+	}
+	if a.preNumber != b.preNumber {
+		return a.preNumber - b.preNumber
+	}
+	if a.post != b.post {
+		return a.post - b.post
+	}
+
+	// a version without a development release comes after any development release of it.
+	if a.dev != b.dev {
+
+		if a.dev < 0 {
+			return 1
+		}
+		if b.dev < 0 {
+			return -1
+		}
+		return a.dev - b.dev
+	}
+	return 0
+}
+
+/*
+	Returns true if the given [version] satisfies every one of the given [specifiers].
+*/
+func satisfiesSpecifiers(version string, specifiers []versionSpecifier) bool {
+
+	var parsed, target packageVersion
+	var valid, prefix bool
+	var comparison int
+
+	parsed, valid = parseVersion(version)
+
+	for _, specifier := range specifiers {
+
+		if specifier.operator == "===" {
+
+			if version != specifier.version {
+				return false
+			}
+			continue
+		}
+
+		if !valid {
+			return false
+		}
+
+		prefix = strings.HasSuffix(specifier.version, ".*")
+
+		target, valid = parseVersion(strings.TrimSuffix(specifier.version, ".*"))
+		if !valid {
+			return false
+		}
+
+		comparison = compareVersions(parsed, target)
+
+		switch specifier.operator {
+		case "==":
+			if prefix && !hasReleasePrefix(parsed, target.release) || !prefix && comparison != 0 {
+				return false
+			}
+		case "!=":
+			if prefix && hasReleasePrefix(parsed, target.release) || !prefix && comparison == 0 {
+				return false
+			}
+		case ">=":
+			if comparison < 0 {
+				return false
+			}
+		case "<=":
+			if comparison > 0 {
+				return false
+			}
+		case ">":
+			if comparison <= 0 {
+				return false
+			}
+		case "<":
+			if comparison >= 0 {
+				return false
+			}
+		case "~=":
+			if comparison < 0 || len(target.release) < 2 || !hasReleasePrefix(parsed, target.release[:len(target.release)-1]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+/*
+	Returns true if the release segment of the given [version] starts with the given [prefix].
+*/
+func hasReleasePrefix(version packageVersion, prefix []int) bool {
+
+	var part int
+
+	for index, expected := range prefix {
+
+		part = 0
+		if index < len(version.release) {
+			part = version.release[index]
+		}
+
+		if part != expected {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(values []string, value string) bool {
+
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
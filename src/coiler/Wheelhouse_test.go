@@ -0,0 +1,305 @@
+package coiler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCompareVersions(test *testing.T) {
+
+	var ordered []string
+	var previous, current packageVersion
+	var valid bool
+
+	// each version comes strictly before the next, as PEP 440 orders them.
+	ordered = []string{
+		"0.9",
+		"1.0.dev1",
+		"1.0a1.dev1",
+		"1.0a1",
+		"1.0a2",
+		"1.0b1",
+		"1.0rc1",
+		"1.0",
+		"1.0.post1.dev1",
+		"1.0.post1",
+		"1.0.post2",
+		"1.1.dev1",
+		"1.1",
+		"1.10",
+		"2",
+		"1!0.1",
+	}
+
+	previous, valid = parseVersion(ordered[0])
+	if !valid {
+		test.Fatalf("'%s' should be a valid version", ordered[0])
+	}
+
+	for index := 1; index < len(ordered); index++ {
+
+		current, valid = parseVersion(ordered[index])
+		if !valid {
+			test.Fatalf("'%s' should be a valid version", ordered[index])
+		}
+
+		if compareVersions(previous, current) >= 0 || compareVersions(current, previous) <= 0 {
+			test.Errorf("expected '%s' to come before '%s'", ordered[index-1], ordered[index])
+		}
+		previous = current
+	}
+}
+
+func TestEquivalentVersions(test *testing.T) {
+
+	var cases = [][2]string{
+		{"1.0", "1.0.0"},
+		{"1.0-1", "1.0.post1"},
+		{"1.0.rev1", "1.0.post1"},
+		{"1.0RC1", "1.0rc1"},
+		{"1.0c1", "1.0rc1"},
+		{"1.0alpha2", "1.0a2"},
+		{"v1.0", "1.0"},
+		{"1.0-dev", "1.0.dev0"},
+		{"1.0+local.1", "1.0"},
+		{"0!1.0", "1.0"},
+	}
+
+	for _, versions := range cases {
+
+		a, validA := parseVersion(versions[0])
+		b, validB := parseVersion(versions[1])
+
+		if !validA || !validB || compareVersions(a, b) != 0 {
+			test.Errorf("expected '%s' and '%s' to be the same version", versions[0], versions[1])
+		}
+	}
+
+	for _, invalid := range []string{"", "one", "1.0-beta-2-3-4", "1..0", "latest"} {
+		if _, valid := parseVersion(invalid); valid {
+			test.Errorf("expected '%s' not to be a valid version", invalid)
+		}
+	}
+}
+
+func TestSatisfiesSpecifiers(test *testing.T) {
+
+	var cases = []struct {
+		specifiers string
+		version    string
+		expected   bool
+	}{
+		{"~=2.2", "2.2", true},
+		{"~=2.2", "2.9.1", true},
+		{"~=2.2", "3.0", false},
+		{"~=2.2", "2.1", false},
+		{"~=1.4.5", "1.4.9", true},
+		{"~=1.4.5", "1.5.0", false},
+		{"~=1.4.5", "1.4.4", false},
+		{"~=1", "1.0", false},
+		{"==1.*", "1.9.3", true},
+		{"==1.*", "1.0", true},
+		{"==1.*", "2.0", false},
+		{"==1.4.*", "1.4", true},
+		{"==1.4.*", "1.40", false},
+		{"!=1.2.*", "1.2.3", false},
+		{"!=1.2.*", "1.3", true},
+		{"==1.0", "1.0.0", true},
+		{"==1.0", "1.0.post1", false},
+		{"!=1.0", "1.0.0", false},
+		{"===1.0", "1.0", true},
+		{"===1.0", "1.0.0", false},
+		{">=1.0,<2", "1.5", true},
+		{">=1.0,<2", "2.0", false},
+		{">=1.0,<2", "0.9", false},
+		{">1.0", "1.0", false},
+		{">1.0", "1.0.1", true},
+		{"<=1.0", "1.0", true},
+		{"<2", "2.0rc1", true},
+		{">=1.0", "not-a-version", false},
+		{"", "anything", true},
+	}
+
+	for _, testCase := range cases {
+
+		var specifiers []versionSpecifier
+
+		for _, specifier := range strings.Split(testCase.specifiers, ",") {
+
+			matches := specifierRegex.FindStringSubmatch(specifier)
+			if matches != nil {
+				specifiers = append(specifiers, versionSpecifier{operator: matches[1], version: matches[2]})
+			}
+		}
+
+		if satisfiesSpecifiers(testCase.version, specifiers) != testCase.expected {
+			test.Errorf("expected '%s' satisfying '%s' to be %v", testCase.version, testCase.specifiers, testCase.expected)
+		}
+	}
+}
+
+func TestParseRequirement(test *testing.T) {
+
+	var cases = []struct {
+		line       string
+		name       string
+		text       string
+		specifiers []versionSpecifier
+		hashes     []string
+		hasMarker  bool
+	}{
+		{
+			line: "requests",
+			name: "requests",
+			text: "requests",
+		},
+		{
+			line:       "Foo_Bar.baz[socks, tests] >=2.0, <3",
+			name:       "foo-bar-baz",
+			text:       "Foo_Bar.baz[socks, tests] >=2.0, <3",
+			specifiers: []versionSpecifier{{">=", "2.0"}, {"<", "3"}},
+		},
+		{
+			line:       "six (==1.16.0)",
+			name:       "six",
+			text:       "six (==1.16.0)",
+			specifiers: []versionSpecifier{{"==", "1.16.0"}},
+		},
+		{
+			line:       "attrs==23.1.0 --hash=sha256:ABCDEF --hash=sha256:012345",
+			name:       "attrs",
+			text:       "attrs==23.1.0",
+			specifiers: []versionSpecifier{{"==", "23.1.0"}},
+			hashes:     []string{"012345", "abcdef"},
+		},
+		{
+			line:       "importlib-metadata>=4 ; python_version < \"3.8\" and sys_platform != 'win32' --hash=sha256:aa",
+			name:       "importlib-metadata",
+			text:       "importlib-metadata>=4 ; python_version < \"3.8\" and sys_platform != 'win32'",
+			specifiers: []versionSpecifier{{">=", "4"}},
+			hashes:     []string{"aa"},
+			hasMarker:  true,
+		},
+	}
+
+	for _, testCase := range cases {
+
+		parsed, err := parseRequirement(testCase.line)
+		if err != nil {
+			test.Errorf("'%s': unexpected error: %v", testCase.line, err)
+			continue
+		}
+
+		if parsed.name != testCase.name || parsed.text != testCase.text || (parsed.marker != nil) != testCase.hasMarker {
+			test.Errorf("'%s': expected name '%s', text '%s' and a marker (%v), got '%s', '%s' and %v",
+				testCase.line, testCase.name, testCase.text, testCase.hasMarker, parsed.name, parsed.text, parsed.marker != nil)
+		}
+
+		if !reflect.DeepEqual(parsed.specifiers, testCase.specifiers) {
+			test.Errorf("'%s': expected specifiers %v, got %v", testCase.line, testCase.specifiers, parsed.specifiers)
+		}
+
+		if !reflect.DeepEqual(parsed.hashes, testCase.hashes) {
+			test.Errorf("'%s': expected hashes %v, got %v", testCase.line, testCase.hashes, parsed.hashes)
+		}
+	}
+
+	for _, invalid := range []string{
+		"attrs --hash=md5:abcdef",
+		"pkg @ https://example.com/pkg.whl",
+		"./wheels/pkg-1.0-py3-none-any.whl",
+		"pkg =>1.0",
+		"pkg ; python_version <",
+		"pkg ; python_version < \"3.8",
+		"pkg ; (os_name == \"nt\"",
+		"-not-a-name",
+	} {
+		if _, err := parseRequirement(invalid); err == nil {
+			test.Errorf("expected '%s' not to be a valid requirement", invalid)
+		}
+	}
+}
+
+func TestIsCompatiblePythonTag(test *testing.T) {
+
+	var cpython311, pypy39, python27 markerEnvironment
+
+	cpython311 = markerEnvironment{"python_version": "3.11", "implementation_name": "cpython"}
+	pypy39 = markerEnvironment{"python_version": "3.9", "implementation_name": "pypy"}
+	python27 = markerEnvironment{"python_version": "2.7", "implementation_name": "cpython"}
+
+	var cases = []struct {
+		tag         string
+		environment markerEnvironment
+		expected    bool
+	}{
+		{"py3", cpython311, true},
+		{"py2", cpython311, false},
+		{"py2.py3", cpython311, true},
+		{"py2.py3", python27, true},
+		{"py3", python27, false},
+		{"py38", cpython311, true},
+		{"py311", cpython311, true},
+		{"py312", cpython311, false},
+		{"py39", pypy39, true},
+		{"cp311", cpython311, true},
+		{"cp310", cpython311, false},
+		{"cp39", pypy39, false},
+		{"pp39", pypy39, true},
+		{"pp39", cpython311, false},
+		{"", cpython311, false},
+	}
+
+	for _, testCase := range cases {
+
+		if isCompatiblePythonTag(testCase.tag, testCase.environment) != testCase.expected {
+			test.Errorf("expected '%s' being compatible with %v to be %v", testCase.tag, testCase.environment, testCase.expected)
+		}
+	}
+}
+
+func TestMakePrivateDirectory(test *testing.T) {
+
+	var directory string
+	var info os.FileInfo
+
+	root, err := ioutil.TempDir("", "coiler-private")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	directory = filepath.Join(root, "cache", "wheels")
+
+	err = makePrivateDirectory(directory)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	info, err = os.Stat(directory)
+	if err != nil || info.Mode().Perm() != 0700 {
+		test.Errorf("expected '%s' to be made private, got %v (%v)", directory, info.Mode(), err)
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	// a directory others could have written to can't be trusted, even if it's ours.
+	os.Chmod(directory, 0777)
+
+	if makePrivateDirectory(directory) == nil {
+		test.Errorf("expected a directory writable by other users to be refused")
+	}
+
+	os.Symlink(root, filepath.Join(root, "link"))
+
+	if makePrivateDirectory(filepath.Join(root, "link")) == nil {
+		test.Errorf("expected a link to be refused")
+	}
+}